@@ -0,0 +1,52 @@
+package lexer
+
+import "unicode"
+
+// ASCIIDigit returns the value of r if it is one of the ASCII digits 0 to 9.
+func ASCIIDigit(r rune) (int, bool) {
+	if r >= '0' && r <= '9' {
+		return int(r - '0'), true
+	}
+	return 0, false
+}
+
+// UnicodeDigit returns the value of r if it is a decimal digit in any script,
+// such as the Arabic-Indic or Devanagari digits.
+func UnicodeDigit(r rune) (int, bool) {
+	if !unicode.Is(unicode.Nd, r) {
+		return 0, false
+	}
+	// Unicode encodes decimal digits in contiguous runs from zero to nine, and
+	// every range in the table starts at a zero.
+	for _, rng := range unicode.Nd.R16 {
+		if r >= rune(rng.Lo) && r <= rune(rng.Hi) {
+			return int(r-rune(rng.Lo)) % 10, true
+		}
+	}
+	for _, rng := range unicode.Nd.R32 {
+		if r >= rune(rng.Lo) && r <= rune(rng.Hi) {
+			return int(r-rune(rng.Lo)) % 10, true
+		}
+	}
+	return 0, false
+}
+
+// TakeDigits takes every upcoming decimal digit, as classified by the
+// DigitClassifier, and returns the number of digits taken along with the value
+// they spell out in base 10. The value is only meaningful if it fits in an int,
+// and can be attached to the emitted token with EmitWith.
+func (l *L) TakeDigits() (value, n int) {
+	classify := l.DigitClassifier
+	if classify == nil {
+		classify = ASCIIDigit
+	}
+	for {
+		d, ok := classify(l.Next())
+		if !ok {
+			l.Backup()
+			return value, n
+		}
+		value = value*10 + d
+		n++
+	}
+}
@@ -0,0 +1,28 @@
+package lexer
+
+// LexError is the error stored in Err when lexing fails. Along with the message
+// it records where in the input the error occurred.
+type LexError struct {
+	// Pos is the byte offset at which the error occurred, and Line and Column
+	// are its line and column.
+	Pos          int
+	Line, Column int
+	// TokenStart is the byte offset at which the token being analyzed began.
+	TokenStart int
+	Message    string
+}
+
+func (e *LexError) Error() string {
+	return e.Message
+}
+
+// newError returns a LexError for the current position of the lexer.
+func (l *L) newError(msg string) *LexError {
+	return &LexError{
+		Pos:        l.Position,
+		Line:       l.Line,
+		Column:     l.Column,
+		TokenStart: l.Start,
+		Message:    msg,
+	}
+}
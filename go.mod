@@ -4,4 +4,4 @@ retract (
 	v1.0.0 // Should not have been published.
 )
 
-go 1.17
+go 1.23
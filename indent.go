@@ -0,0 +1,62 @@
+package lexer
+
+// MeasureIndent returns the width of the spaces and tabs starting at the current
+// Position, which is expected to be the start of a line, without taking them. A
+// tab advances the width to the next multiple of IndentTabWidth, or by one if
+// IndentTabWidth is not set.
+func (l *L) MeasureIndent() int {
+	width := 0
+	for pos := l.Position; ; {
+		r, w := l.decode(pos)
+		switch r {
+		case ' ':
+			width++
+		case '\t':
+			if l.IndentTabWidth > 1 {
+				width += l.IndentTabWidth - width%l.IndentTabWidth
+			} else {
+				width++
+			}
+		default:
+			return width
+		}
+		pos += w
+	}
+}
+
+// EmitIndent takes the indentation at the start of a line and compares it to the
+// enclosing indentation levels, which the lexer keeps on a stack. A deeper
+// indentation is emitted as an indent token, and a shallower one emits a dedent
+// token for every level it closes. At EOF every open level is closed. If the
+// indentation does not match any enclosing level, it is reported through Errorf
+// and false is returned.
+//
+// Blank lines and lines holding only a comment should usually be skipped before
+// calling EmitIndent, so they do not change the indentation.
+func (l *L) EmitIndent(indent, dedent TokenType) bool {
+	width := l.MeasureIndent()
+	l.TakeMany(" \t")
+	if width > l.indentLevel() {
+		l.indents = append(l.indents, width)
+		l.Emit(indent)
+		return true
+	}
+	l.Ignore()
+	for width < l.indentLevel() {
+		l.indents = l.indents[:len(l.indents)-1]
+		l.Emit(dedent)
+	}
+	if width != l.indentLevel() {
+		l.Errorf("unindent does not match any outer indentation level")
+		return false
+	}
+	return true
+}
+
+// indentLevel returns the innermost indentation level.
+func (l *L) indentLevel() int {
+	if len(l.indents) == 0 {
+		return 0
+	}
+	return l.indents[len(l.indents)-1]
+}
@@ -0,0 +1,52 @@
+package lexer
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MarshalJSON encodes the token type as its registered name, or as its number
+// if it has none.
+func (t TokenType) MarshalJSON() ([]byte, error) {
+	if name, ok := tokenNames[t]; ok {
+		return json.Marshal(name)
+	}
+	return json.Marshal(int(t))
+}
+
+// UnmarshalJSON decodes a token type encoded by MarshalJSON, looking names up
+// among the registered token names.
+func (t *TokenType) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		var n int
+		if err := json.Unmarshal(data, &n); err != nil {
+			return err
+		}
+		*t = TokenType(n)
+		return nil
+	}
+	for typ, registered := range tokenNames {
+		if registered == name {
+			*t = typ
+			return nil
+		}
+	}
+	return fmt.Errorf("no token type registered as %q", name)
+}
+
+// MarshalTokens encodes tokens as a JSON array, for passing them to tools that
+// are not written in Go.
+func MarshalTokens(tokens []Token) ([]byte, error) {
+	return json.Marshal(tokens)
+}
+
+// UnmarshalTokens decodes tokens encoded by MarshalTokens. Attributes come back
+// as the generic values encoding/json decodes into an interface.
+func UnmarshalTokens(data []byte) ([]Token, error) {
+	var tokens []Token
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
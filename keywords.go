@@ -0,0 +1,78 @@
+package lexer
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// Keywords is a set of keywords compiled into a trie, so MatchKeyword can find
+// the longest one at the current Position in a single walk over the input.
+type Keywords struct {
+	root keywordNode
+}
+
+type keywordNode struct {
+	children map[rune]*keywordNode
+	keyword  string
+	terminal bool
+	// bounded is set for keywords ending in a rune that can be part of an
+	// identifier, which must not be followed by another one.
+	bounded bool
+}
+
+// NewKeywords returns the set of the given keywords.
+func NewKeywords(words ...string) *Keywords {
+	k := &Keywords{}
+	for _, w := range words {
+		n := &k.root
+		for _, r := range w {
+			if n.children == nil {
+				n.children = make(map[rune]*keywordNode)
+			}
+			child, ok := n.children[r]
+			if !ok {
+				child = &keywordNode{}
+				n.children[r] = child
+			}
+			n = child
+		}
+		last, _ := utf8.DecodeLastRuneInString(w)
+		n.keyword, n.terminal, n.bounded = w, true, isWordRune(last)
+	}
+	return k
+}
+
+// MatchKeyword takes the longest keyword in k that the upcoming input starts
+// with and returns it. A keyword ending in a letter, digit or underscore only
+// matches if the input does not continue with one, so "int" does not match the
+// start of "interface". If no keyword matches, the Position is left untouched
+// and false is returned.
+func (l *L) MatchKeyword(k *Keywords) (string, bool) {
+	var match *keywordNode
+	n := &k.root
+	for pos := l.Position; ; {
+		r, w := l.decode(pos)
+		if n.terminal && !(n.bounded && isWordRune(r)) {
+			match = n
+		}
+		if w == 0 {
+			break
+		}
+		if n = n.children[r]; n == nil {
+			break
+		}
+		pos += w
+	}
+	if match == nil {
+		return "", false
+	}
+	for end := l.Position + len(match.keyword); l.Position < end; {
+		l.Next()
+	}
+	return match.keyword, true
+}
+
+// isWordRune returns whether r can be part of an identifier.
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -1,10 +1,19 @@
 package lexer
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"iter"
+	"reflect"
 	"regexp"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
 	"unicode/utf8"
 )
 
@@ -15,24 +24,211 @@ type TokenType int
 const (
 	EOFToken TokenType = -1
 	ErrorToken TokenType = 0
+
+	// FirstUserToken is the first token type free for grammars to use. Since
+	// ErrorToken is the zero value of TokenType, starting an enumeration of
+	// token types at FirstUserToken keeps a forgotten type from looking like
+	// an error.
+	FirstUserToken TokenType = 1
 )
 
 type Token struct {
-	Type  TokenType
-	Value string
-	Start int
-	End int
+	Type  TokenType `json:"type"`
+	Value string    `json:"value"`
+	Start int       `json:"start"`
+	End int         `json:"end"`
+	Line   int      `json:"line"`
+	Column int      `json:"column"`
+	RuneStart int   `json:"runeStart"`
+	RuneEnd   int   `json:"runeEnd"`
+
+	// Attr holds optional data attached to the token by EmitWith.
+	Attr any `json:"attr,omitempty"`
+
+	// lazy is set for tokens whose Value was left for Resolve to slice out of
+	// the input.
+	lazy bool
 }
 
 type L struct {
 	Input          string
 	Start, Position int
+	Line, Column    int
 	StartState      StateFunc
 	Err             error
 	Tokens          chan Token
 	ErrorHandler    func(e string)
 	Rewind          runeStack
 	StateRecord     stateStack
+
+	// BufferSize is the capacity of the Tokens channel. If it is not set, half
+	// the length of the Input is used.
+	BufferSize int
+
+	// StateHook, if set, is called with the name of each state function and the
+	// current Position just before the state function runs.
+	StateHook func(name string, pos int)
+
+	// MaxTokens, if set, is the most tokens the lexer will emit. Emitting
+	// another token emits an ErrorToken instead and stops the lexer.
+	MaxTokens int
+
+	// MaxBacktrack, if set, is the most runes the lexer will back up over
+	// between one Emit or Ignore and the next with Backup, RewindToken or
+	// Restore, guarding against grammars whose lookahead backtracks excessively
+	// on some inputs. Backing up over the furthest rune read so far, as Take and
+	// TakeWhile do with the rune they look ahead at, is not counted. Backing up
+	// further emits an ErrorToken and stops the lexer.
+	MaxBacktrack int
+
+	// IndentTabWidth is the width of the tab stops used by MeasureIndent and
+	// EmitIndent. If it is not set, a tab is as wide as a space.
+	IndentTabWidth int
+
+	// DigitClassifier, if set, maps a rune to its value as a decimal digit for
+	// TakeDigits, reporting false for runes that are not digits. If it is not
+	// set, ASCIIDigit is used. UnicodeDigit accepts the digits of every script.
+	DigitClassifier func(rune) (int, bool)
+
+	// EmitEOF, if set, makes the lexer emit an EOFToken positioned where it
+	// ended just before it finishes, so consumers see an explicit end of the
+	// token stream rather than only the Tokens channel being closed.
+	EmitEOF bool
+
+	// LazyValues, if set, makes Emit, EmitWith and EmitNonEmpty leave the
+	// Value of their tokens empty rather than copying it out of the input,
+	// while still setting their Type and positions. This suits consumers that
+	// only need the values of a few tokens, or none at all when scanning a
+	// large input for its structure. Token.Resolve returns the value of such a
+	// token on demand.
+	LazyValues bool
+
+	// NoValues is the same switch as LazyValues under the name of a dry-run
+	// mode, for scans that only report the types and positions of tokens.
+	// Setting either one is enough.
+	NoValues bool
+
+	// OnEmit, if set, is called with every token pushed by Emit and the other
+	// emitting methods just before it is delivered, and may modify it, for
+	// example to normalize its value. Error and EOF tokens are not passed to it.
+	// Tokens are given their Value before being passed to it even if
+	// LazyValues or NoValues is set.
+	OnEmit func(*Token)
+
+	// TabWidth is the width of the tab stops used for the Column. A tab moves
+	// the Column to the next tab stop if it is set above 1, and by one column
+	// otherwise.
+	TabWidth int
+
+	// NormalizeNewlines, if set, makes Next, Peek and the other methods reading
+	// runes treat "\r\n" as a single '\n'. The '\r' is left out of token values
+	// but still counts towards their byte offsets, so they keep referring to
+	// the Input. Methods matching regular expressions against the Input, such as
+	// TakePattern, still see the '\r'.
+	NormalizeNewlines bool
+
+	startLine, startColumn int
+
+	// runeStart and runePos count the runes before Start and Position.
+	runeStart, runePos int
+
+	// indents is the stack of enclosing indentation levels used by
+	// EmitIndent.
+	indents []int
+
+	// count is the number of tokens emitted.
+	count int
+
+	// last is the most recently emitted token, if hasLast is set.
+	last    Token
+	hasLast bool
+
+	// state is the state function to run next. started and finished are set
+	// once the lexer has begun running and once it has closed Tokens.
+	state             StateFunc
+	started, finished bool
+
+	// sink, if set, receives emitted tokens in place of the Tokens channel.
+	// Lexers driven by NextPull use it to buffer tokens in pending.
+	sink    func(Token) error
+	pending []Token
+
+	// unshifted holds the tokens queued by Unshift, and n the number of them.
+	// It is guarded by a mutex since Unshift may be called from the consumer
+	// as well as from the goroutine running the lexer. stepping is set while a
+	// state function runs, to tell the two apart.
+	unshifted struct {
+		sync.Mutex
+		tokens []queuedToken
+		n      atomic.Int64
+	}
+	stepping atomic.Bool
+
+	// stopped is set once the lexer should end regardless of the state
+	// returned by the current state function. recoverable is set along with it
+	// by Error, which RecoverTo can undo.
+	stopped     bool
+	recoverable bool
+
+	// errs holds every error recorded by Error, EmitError and fail.
+	errs []error
+
+	// bom is set once StripBOM has skipped a byte order mark.
+	bom bool
+
+	// backtracked is the number of runes backed up over since the last Emit or
+	// Ignore, which is checked against MaxBacktrack, and reach is the furthest
+	// Position read since then.
+	backtracked int
+	reach       int
+
+	// ignored holds the ranges of the pending token that are left out of its
+	// value, in order.
+	ignored []byteRange
+
+	// ctx is the context given to RunLexerContext, if any.
+	ctx context.Context
+
+	// fromBytes is set for lexers whose input is held in buf rather than
+	// Input, which begins at the byte offset base. For lexers created with
+	// NewFromReader, reader is the source of runes and buf holds those read
+	// so far, trimmed each time a token is emitted or ignored.
+	fromBytes bool
+	reader    io.RuneReader
+	buf       []byte
+	base      int
+
+	// observed holds copies of Start and Position for AtomicStart and
+	// AtomicPosition, updated each time the lexer moves them.
+	observed struct{ start, position atomic.Int64 }
+}
+
+// inputReader reads the runes of a lexer's input from pos onwards without
+// moving the lexer.
+type inputReader struct {
+	l   *L
+	pos int
+}
+
+func (r *inputReader) ReadRune() (rune, int, error) {
+	c, w := r.l.decode(r.pos)
+	if w == 0 {
+		return 0, 0, io.EOF
+	}
+	r.pos += w
+	return c, w, nil
+}
+
+// queuedToken is a token queued by Unshift. Tokens queued from a state function
+// are inline, and only delivered in emit order.
+type queuedToken struct {
+	tok    Token
+	inline bool
+}
+
+// byteRange is a half-open range of byte offsets into the input.
+type byteRange struct {
+	start, end int
 }
 
 func (t Token) String() string {
@@ -42,11 +238,16 @@ func (t Token) String() string {
 	case ErrorToken:
 		return t.Value
 	}
+	var value string
 	if len(t.Value) > 10 {
-		return fmt.Sprintf("%.10q...", t.Value)
+		value = fmt.Sprintf("%.10q...", t.Value)
 	} else {
-		return fmt.Sprintf("%q", t.Value)
+		value = fmt.Sprintf("%q", t.Value)
 	}
+	if name, ok := tokenNames[t.Type]; ok {
+		return name + "(" + value + ")"
+	}
+	return value
 }
 
 // New creates a returns a lexer ready to parse the given Input code.
@@ -56,126 +257,663 @@ func New(src string, Start StateFunc) *L {
 		StartState: Start,
 		Start:      0,
 		Position:   0,
+		Line:       1,
+		Column:     1,
+		startLine:  1,
+		startColumn: 1,
 		Rewind:     NewRuneStack(),
 		StateRecord: NewStateStack(),
 	}
 	return l
 }
 
-// Start begins executing the Lexer in an asynchronous manner (using a goroutine).
-func (l *L) RunLexer() {
-	// Take half the string length as a buffer size.
-	buffSize := len(l.Input) / 2
-	if buffSize <= 0 {
-		buffSize = 1
-	}
-	l.Tokens = make(chan Token, buffSize)
+// NewFromReader creates and returns a lexer that pulls its input lazily from
+// the given reader. Only the runes since the last Emit or Ignore are buffered,
+// so Input is left empty and offsets are relative to the UTF-8 encoding of the
+// runes read.
+func NewFromReader(r io.RuneReader, Start StateFunc) *L {
+	l := New("", Start)
+	l.fromBytes = true
+	l.reader = r
+	return l
+}
+
+// NewFromBytes creates and returns a lexer that parses b directly rather than
+// copying it into a string first, so Input is left empty. Token values are only
+// copied out of b when they are emitted, and b must not be modified while the
+// lexer is in use.
+func NewFromBytes(b []byte, Start StateFunc) *L {
+	l := New("", Start)
+	l.fromBytes = true
+	l.buf = b
+	return l
+}
+
+// Reset prepares the lexer to parse src from the beginning as if it had just
+// been created with New, keeping its StartState and ErrorHandler. A fresh Tokens
+// channel is made the next time the lexer is run.
+func (l *L) Reset(src string) {
+	l.Input = src
+	l.Start, l.Position = 0, 0
+	l.Line, l.Column = 1, 1
+	l.startLine, l.startColumn = 1, 1
+	l.runeStart, l.runePos = 0, 0
+	l.Err = nil
+	l.Tokens = nil
+	l.state = nil
+	l.started, l.finished = false, false
+	l.sink, l.pending = nil, nil
+	l.unshifted.tokens = nil
+	l.unshifted.n.Store(0)
+	l.count = 0
+	l.last, l.hasLast = Token{}, false
+	l.stopped, l.recoverable = false, false
+	l.errs = nil
+	l.bom = false
+	l.backtracked, l.reach = 0, l.Position
+	l.Rewind.Clear()
+	l.StateRecord.Clear()
+	l.ignored = nil
+	l.indents = nil
+	l.ctx = nil
+	l.fromBytes = false
+	l.reader, l.buf, l.base = nil, nil, 0
+	l.publish()
+}
+
+// Start begins executing the Lexer in an asynchronous manner (using a goroutine)
+// and returns the channel the tokens are sent on, as in `tokens := l.RunLexer()`.
+// The channel is also kept in the Tokens field, and does not exist until the
+// lexer is started. The goroutine only exits once every token has been received,
+// so callers that stop reading early should Drain the lexer, or use
+// RunLexerContext and cancel it, before abandoning it.
+func (l *L) RunLexer() <-chan Token {
+	l.makeTokens()
 	go l.run()
+	return l.Tokens
+}
+
+// RunLexerContext begins executing the Lexer asynchronously like RunLexer, but
+// stops lexing and closes the Tokens channel once ctx is done, even if nothing
+// is reading from it. When that happens Err is set to ctx.Err().
+func (l *L) RunLexerContext(ctx context.Context) <-chan Token {
+	l.ctx = ctx
+	return l.RunLexer()
 }
 
 func (l *L) RunLexerSync() {
-	// Take half the string length as a buffer size.
-	buffSize := len(l.Input) / 2
-	if buffSize <= 0 {
-		buffSize = 1
-	}
-	l.Tokens = make(chan Token, buffSize)
+	l.makeTokens()
 	l.run()
 }
 
+// RunLexerFunc executes the Lexer synchronously, passing every token to sink as
+// it is emitted rather than sending it on the Tokens channel. If sink returns an
+// error, it is recorded in Err and the lexer stops once the current state
+// function returns.
+func (l *L) RunLexerFunc(sink func(Token) error) {
+	l.restart()
+	l.sink = sink
+	l.run()
+}
+
+// LineNumber returns the 1-based line of the current Position, which is the
+// number of lines read so far. It is the value of the Line field, which the
+// lexer keeps up to date as it moves.
+func (l *L) LineNumber() int {
+	return l.Line
+}
+
+// RunePosition returns the number of runes before the current Position.
+func (l *L) RunePosition() int {
+	return l.runePos
+}
+
+// Rest returns the input that has not been consumed yet. For a lexer reading
+// from an io.RuneReader this reads the remainder of the input into memory.
+func (l *L) Rest() string {
+	return l.slice(l.Position, l.end())
+}
+
+// Span returns the byte offsets of the section of the Input being analyzed,
+// which is the span the next emitted token will have.
+func (l *L) Span() (start, end int) {
+	return l.Start, l.Position
+}
+
+// Consumed returns the input before the current Position. For a lexer reading
+// from an io.RuneReader only the input since the last Emit or Ignore is kept, so
+// only that is returned.
+func (l *L) Consumed() string {
+	return l.slice(l.base, l.Position)
+}
+
+// Step runs a single state function, starting at StartState the first time it
+// is called and making the Tokens channel if the lexer has not been run yet. It
+// returns false once the lexer has ended, at which point the Tokens channel is
+// closed. Tokens emitted while stepping wait on the Tokens channel, so its
+// BufferSize has to be large enough for them unless another goroutine is
+// receiving.
+func (l *L) Step() bool {
+	if !l.started {
+		if l.Tokens == nil && l.sink == nil {
+			l.makeTokens()
+		}
+		l.started = true
+		l.state = l.StartState
+		if l.state == nil {
+			l.fail("lexer has no StartState")
+		}
+	}
+	if l.state != nil && !l.stopped {
+		if l.ctx != nil && l.ctx.Err() != nil {
+			l.Err = l.ctx.Err()
+			l.state = nil
+		} else {
+			l.stepping.Store(true)
+			l.step()
+			l.stepping.Store(false)
+			l.flush()
+		}
+	}
+	if l.state == nil || l.stopped {
+		if !l.finished {
+			l.finished = true
+			if l.EmitEOF {
+				l.send(l.eof())
+			}
+			if l.sink == nil {
+				close(l.Tokens)
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// NextPull returns the next token from the lexer, running state functions on
+// demand until one is emitted, and false once the lexer has ended. It never
+// starts a goroutine or makes the Tokens channel, so a lexer driven by NextPull
+// must not also be run with RunLexer or RunLexerSync.
+func (l *L) NextPull() (Token, bool) {
+	if l.sink == nil {
+		l.sink = l.buffer
+	}
+	for done := false; ; done = !l.Step() {
+		if tok, ok := l.shift(); ok {
+			return tok, true
+		}
+		if len(l.pending) > 0 {
+			tok := l.pending[0]
+			l.pending = l.pending[:copy(l.pending, l.pending[1:])]
+			return tok, true
+		}
+		if done {
+			return Token{}, false
+		}
+	}
+}
+
+// Progress returns the fraction of the input consumed so far, from 0 to 1. The
+// length of the input is not known ahead of time for a lexer reading from an
+// io.RuneReader, so it always returns -1.
+func (l *L) Progress() float64 {
+	n := l.BytesRemaining()
+	if n < 0 {
+		return -1
+	}
+	if n+l.Position == 0 {
+		return 1
+	}
+	return float64(l.Position) / float64(n+l.Position)
+}
+
+// BytesRemaining returns the number of bytes of input after the current
+// Position, or -1 for a lexer reading from an io.RuneReader.
+func (l *L) BytesRemaining() int {
+	switch {
+	case !l.fromBytes:
+		return len(l.Input) - l.Position
+	case l.reader == nil:
+		return len(l.buf) - l.Position
+	}
+	return -1
+}
+
+// AtomicPosition returns the current Position, and is safe to call from another
+// goroutine while the lexer runs, for example to report progress. It reflects
+// the Position as of the last time the lexer moved it, so direct assignments to
+// Position are only seen once the lexer moves again.
+func (l *L) AtomicPosition() int {
+	return int(l.observed.position.Load())
+}
+
+// AtomicStart works like AtomicPosition but returns the beginning of the token
+// being analyzed.
+func (l *L) AtomicStart() int {
+	return int(l.observed.start.Load())
+}
+
+// Seek moves both Start and Position to the byte offset pos and clears the Rewind
+// stack, so lexing can be restarted from a known point, for example with
+// RunLexerSync after an edit to the Input. It returns an error if pos is outside
+// of the input or in the middle of a multi-byte rune, and for lexers reading
+// from an io.RuneReader, which cannot seek.
+func (l *L) Seek(pos int) error {
+	if l.reader != nil {
+		return errors.New("cannot seek a lexer reading from an io.RuneReader")
+	}
+	if pos < 0 || pos > l.end() {
+		return fmt.Errorf("seek offset %d is outside of the input", pos)
+	}
+	if pos < l.end() && !utf8.RuneStart(l.slice(pos, pos+1)[0]) {
+		return fmt.Errorf("seek offset %d is in the middle of a rune", pos)
+	}
+	l.Line, l.Column, l.runePos = l.locate(pos)
+	l.Position = pos
+	l.advanceStart()
+	l.publish()
+	return nil
+}
+
+// StripBOM skips a UTF-8 byte order mark at the very start of the input,
+// returning whether there was one. The mark still counts towards byte and rune
+// offsets, so they keep referring to the Input, but not towards the Column. It
+// should be called before anything else is read, such as at the start of the
+// StartState.
+func (l *L) StripBOM() bool {
+	if l.Position != 0 || !l.AcceptRune('\uFEFF') {
+		return false
+	}
+	l.Column = 1
+	l.bom = true
+	l.Ignore()
+	return true
+}
+
 // Current returns the value being analyzed at this moment.
 func (l *L) Current() string {
-	return l.Input[l.Start:l.Position]
+	if l.Position <= l.Start {
+		return ""
+	}
+	if len(l.ignored) == 0 {
+		return l.slice(l.Start, l.Position)
+	}
+	var b strings.Builder
+	pos := l.Start
+	for _, r := range l.ignored {
+		b.WriteString(l.slice(pos, r.start))
+		pos = r.end
+	}
+	if pos < l.Position {
+		b.WriteString(l.slice(pos, l.Position))
+	}
+	return b.String()
 }
 
 // Emit will receive a token type and push a new token with the current analyzed
 // value into the Tokens channel.
 func (l *L) Emit(t TokenType) {
-	tok := Token{
-		Type:  t,
-		Value: l.Current(),
-		Start: l.Start,
-		End: l.Position,
+	l.emit(l.current(t))
+}
+
+// EmitAnd emits a token of the given type and returns next, so a state function
+// can emit and move on in one statement with `return l.EmitAnd(t, next)`.
+func (l *L) EmitAnd(t TokenType, next StateFunc) StateFunc {
+	l.Emit(t)
+	return next
+}
+
+// EmitTrimmed works like Emit but trims leading and trailing white space from the
+// token's value. The token still spans the whole analyzed section of the Input.
+func (l *L) EmitTrimmed(t TokenType) {
+	l.EmitValue(t, strings.TrimSpace(l.Current()))
+}
+
+// EmitRest takes the rest of the input and emits it as a single token of the
+// given type.
+func (l *L) EmitRest(t TokenType) {
+	l.TakeWhile(func(rune) bool {
+		return true
+	})
+	l.Emit(t)
+}
+
+// EmitNonEmpty works like Emit but only emits the token if the current analyzed
+// value is not empty, otherwise the section is ignored. It returns whether a
+// token was emitted.
+func (l *L) EmitNonEmpty(t TokenType) bool {
+	if tok := l.current(t); tok.lazy || tok.Value != "" {
+		l.emit(tok)
+		return true
 	}
-	l.Tokens <- tok
-	l.Start = l.Position
-	l.Rewind.Clear()
+	l.Ignore()
+	return false
+}
+
+// EmitValue pushes a token of the given type with the given value into the
+// Tokens channel, in place of the current analyzed value. The token still
+// spans the current analyzed section of the Input.
+func (l *L) EmitValue(t TokenType, value string) {
+	l.emit(l.token(t, value))
+}
+
+// EmitWith works like Emit but attaches attr to the token, for annotations such
+// as the base of an integer literal.
+func (l *L) EmitWith(t TokenType, attr any) {
+	tok := l.current(t)
+	tok.Attr = attr
+	l.emit(tok)
+}
+
+// Split is one of the tokens EmitSplit carves out of the current analyzed
+// section: a token of type Type spanning the next Len runes.
+type Split struct {
+	Type TokenType
+	Len  int
+}
+
+// EmitSplit emits the current analyzed section as several consecutive tokens,
+// one for each of parts, so a section such as `a.b.c` taken in one go can still
+// be emitted as separate tokens with their own positions. Their values are
+// taken from the Input as is, without leaving out ignored characters. If the
+// lengths of parts do not add up to the number of runes in the section, nothing
+// is emitted and an error is returned.
+func (l *L) EmitSplit(parts []Split) error {
+	n := 0
+	for _, p := range parts {
+		if p.Len < 0 {
+			return fmt.Errorf("split length %d is negative", p.Len)
+		}
+		n += p.Len
+	}
+	if runes := l.runePos - l.runeStart; n != runes {
+		return fmt.Errorf("split lengths add up to %d runes but the token has %d", n, runes)
+	}
+	l.rewind()
+	for _, p := range parts {
+		for range p.Len {
+			l.Next()
+		}
+		l.EmitValue(p.Type, l.slice(l.Start, l.Position))
+	}
+	return nil
+}
+
+// EmitToken pushes tok into the Tokens channel exactly as it is, rather than
+// deriving its value and positions from the lexer. The beginning of the next
+// token moves up to tok.End, taking the Input up to it first if it lies beyond
+// the Position, but never moves back before Start. The Rewind stack is cleared
+// either way.
+func (l *L) EmitToken(tok Token) {
+	for l.Position < tok.End && l.Next() != rune(EOFToken) {
+	}
+	pos, line, column, runes := l.Position, l.Line, l.Column, l.runePos
+	l.Position = min(max(tok.End, l.Start), pos)
+	l.Line, l.Column, l.runePos = l.locate(l.Position)
+	l.emit(tok)
+	l.Position, l.Line, l.Column, l.runePos = pos, line, column, runes
+	l.reach = max(l.reach, pos)
+	l.publish()
+}
+
+// LastToken returns the most recently emitted token, and false if no token has
+// been emitted yet.
+func (l *L) LastToken() (Token, bool) {
+	return l.last, l.hasLast
+}
+
+// TokenCount returns the number of tokens emitted so far, not counting error
+// and EOF tokens. Like LastToken, it should be called from a state function or
+// once the lexer has finished.
+func (l *L) TokenCount() int {
+	return l.count
 }
 
 // Ignore clears the Rewind stack and then sets the current beginning Position
 // to the current Position in the Input, which effectively ignores the section
 // of the Input being analyzed.
 func (l *L) Ignore() {
-	l.Start = l.Position
-	l.Rewind.Clear()
+	l.advanceStart()
 }
 
-// IgnoreCharacter removes the current character from the output
+// IgnoreCharacter removes the current character from the output. The Input is
+// left untouched, so the character still counts towards the positions of the
+// emitted token, it is only left out of its value.
 func (l *L) IgnoreCharacter() {
-	r := l.Rewind.Pop()
-	width := utf8.RuneLen(r)
-	l.Input = l.Input[:l.Position - width] + l.Input[l.Position:]
-	l.Position -= width
+	end := l.Position
+	if n := len(l.ignored); n > 0 && l.ignored[n-1].end == end {
+		end = l.ignored[n-1].start
+	}
+	if end <= l.Start {
+		return
+	}
+	_, width := utf8.DecodeLastRuneInString(l.slice(l.Start, end))
+	l.IgnoreRange(end-width, end)
 }
 
-// Peek performs a Next operation immediately followed by a Backup returning the
-// peeked rune.
+// IgnoreRange leaves the bytes of the Input between start and end out of the
+// value of the token being analyzed, such as a line continuation in the middle
+// of it. Like IgnoreCharacter, the Input is left untouched and the token still
+// spans the ignored bytes. The range is clipped to the current analyzed section
+// and may overlap previously ignored ranges.
+func (l *L) IgnoreRange(start, end int) {
+	start, end = max(start, l.Start), min(end, l.Position)
+	if start >= end {
+		return
+	}
+	i, _ := slices.BinarySearchFunc(l.ignored, start, func(r byteRange, start int) int {
+		return r.end - start
+	})
+	j := i
+	for ; j < len(l.ignored) && l.ignored[j].start <= end; j++ {
+		start, end = min(start, l.ignored[j].start), max(end, l.ignored[j].end)
+	}
+	l.ignored = slices.Replace(l.ignored, i, j, byteRange{start, end})
+}
+
+// Peek returns the rune a Next operation would return, without moving the
+// Position or touching the Rewind stack.
 func (l *L) Peek() rune {
-	r := l.Next()
-	l.Backup()
+	r, _ := l.decode(l.Position)
 
 	return r
 }
 
-// PeekMany performs n Next operations immediately followed by n Backup operations
-// returning the last peeked rune.
+// PeekMany returns the rune that n Next operations would end on, without moving
+// the Position or touching the Rewind stack.
 func (l *L) PeekMany(n int) rune {
-	var r rune
-	for i := n; i > 0; i-- {
-		r = l.Next()
+	if n <= 0 {
+		return 0
 	}
-	for i := n; i > 0; i-- {
-		l.Backup()
+
+	return l.RuneAt(n - 1)
+}
+
+// PeekBack returns the last rune consumed without backing up, taken from the
+// Rewind stack or, after an Emit or Ignore, from the Input. It returns EOFToken
+// at the start of the Input.
+func (l *L) PeekBack() rune {
+	if r := l.Rewind.Top(); r > rune(EOFToken) {
+		return r
 	}
+	r, _ := l.decodeLast(l.Position)
+	return r
+}
 
+// RuneAt returns the rune offset runes away from the current Position without
+// changing any lexer state, so RuneAt(0) is the rune Peek would return and
+// RuneAt(-1) is the rune just before the Position. It returns EOFToken for
+// offsets outside of the input.
+func (l *L) RuneAt(offset int) rune {
+	pos := l.Position
+	for ; offset < -1; offset++ {
+		_, w := l.decodeLast(pos)
+		if w == 0 {
+			return rune(EOFToken)
+		}
+		pos -= w
+	}
+	if offset == -1 {
+		r, _ := l.decodeLast(pos)
+		return r
+	}
+	for ; offset > 0; offset-- {
+		_, w := l.decode(pos)
+		if w == 0 {
+			return rune(EOFToken)
+		}
+		pos += w
+	}
+	r, _ := l.decode(pos)
 	return r
 }
 
+// PeekString returns the next n runes, or fewer if EOF comes first, without
+// moving the Position or touching the Rewind stack.
+func (l *L) PeekString(n int) string {
+	pos := l.Position
+	for i := 0; i < n; i++ {
+		_, w := l.decode(pos)
+		if w == 0 {
+			break
+		}
+		pos += w
+	}
+	return l.slice(l.Position, pos)
+}
+
+// PeekRunes returns the next k runes, or fewer if EOF comes first, without
+// moving the Position or touching the Rewind stack.
+func (l *L) PeekRunes(k int) []rune {
+	runes := make([]rune, 0, max(k, 0))
+	for pos := l.Position; len(runes) < k; {
+		r, w := l.decode(pos)
+		if w == 0 {
+			break
+		}
+		runes = append(runes, r)
+		pos += w
+	}
+	return runes
+}
+
 // Backup will take the last rune read (if any) and back up. Backups can
 // occur more than once per call to Next, but you can never Backup past the
 // last point a token was emitted.
 func (l *L) Backup() bool {
 	r := l.Rewind.Pop()
 	if r > rune(EOFToken) {
-		size := utf8.RuneLen(r)
+		if l.Position < l.reach {
+			l.backtrack(1)
+		}
+		// Invalid UTF-8 is read as utf8.RuneError one byte at a time, so the
+		// width has to come from the input rather than from the rune.
+		_, size := l.decodeLast(l.Position)
 		l.Position -= size
 		if l.Position < l.Start {
 			l.Position = l.Start
+			l.Line, l.Column = l.startLine, l.startColumn
+			l.runePos = l.runeStart
+			l.ignored = l.ignored[:0]
+			l.observed.position.Store(int64(l.Position))
 			return true
 		}
+		if r == '\n' || (r == '\t' && l.TabWidth > 1) {
+			if r == '\n' {
+				l.Line--
+			}
+			l.Column = l.column()
+		} else {
+			l.Column--
+		}
+		l.runePos--
+		for n := len(l.ignored); n > 0 && l.ignored[n-1].start >= l.Position; n-- {
+			l.ignored = l.ignored[:n-1]
+		}
+		l.observed.position.Store(int64(l.Position))
 	}
 	return false
 }
 
+// BackupMany will Backup up to n times, stopping early when there is nothing
+// left to back up or it reaches the last point a token was emitted. It returns
+// the number of runes backed up. The EOFToken pushed by a Next at the end of
+// the input is backed up over without counting, since it does not move the
+// Position.
+func (l *L) BackupMany(n int) int {
+	i := 0
+	for i < n && l.Rewind.Len() > 0 {
+		pos := l.Position
+		stop := l.Backup()
+		if l.Position < pos {
+			i++
+		}
+		if stop {
+			break
+		}
+	}
+	return i
+}
+
+// RewindToken moves the Position back to Start and clears the Rewind stack,
+// giving up on everything taken since the last Emit or Ignore so it can be
+// analyzed again.
+func (l *L) RewindToken() {
+	l.backtrack(l.runePos - l.runeStart)
+	l.rewind()
+}
+
+// rewind moves the Position back to Start like RewindToken, without counting
+// towards MaxBacktrack.
+func (l *L) rewind() {
+	l.Position = l.Start
+	l.Line, l.Column = l.startLine, l.startColumn
+	l.runePos = l.runeStart
+	l.Rewind.Clear()
+	l.ignored = l.ignored[:0]
+	l.publish()
+}
+
 // Next pulls the next rune from the Lexer and returns it, moving the Position
-// forward in the Input.
+// forward in the Input. At the end of the Input it returns EOFToken without
+// moving, and each of those calls is undone by a Backup that leaves the
+// Position at the end, so Next and Backup always pair up.
 func (l *L) Next() rune {
-	var (
-		r rune
-		s int
-	)
-	str := l.Input[l.Position:]
-	if len(str) == 0 {
-		r, s = rune(EOFToken), 0
-	} else {
-		r, s = utf8.DecodeRuneInString(str)
-	}
+	r, s := l.decode(l.Position)
 	l.Position += s
+	l.reach = max(l.reach, l.Position)
+	if r == '\n' {
+		l.Line++
+		l.Column = 1
+		if s == 2 {
+			// A "\r\n" read with NormalizeNewlines is left out of the value
+			// as a single '\n'.
+			l.IgnoreRange(l.Position-2, l.Position-1)
+		}
+	} else if s > 0 {
+		l.Column = l.nextColumn(l.Column, r)
+	}
+	if s > 0 {
+		l.runePos++
+		l.observed.position.Store(int64(l.Position))
+	}
 	l.Rewind.Push(r)
 
 	return r
 }
 
+// NextValidated works like Next but also reports whether the rune was decoded
+// from valid UTF-8, telling an invalid byte, which Next returns as
+// utf8.RuneError, apart from a genuine U+FFFD in the Input. Lexers made with
+// NewFromReader only see the runes their io.RuneReader decodes, so there
+// NextValidated always reports true.
+func (l *L) NextValidated() (rune, bool) {
+	pos := l.Position
+	r := l.Next()
+
+	return r, r != utf8.RuneError || l.Position-pos != 1
+}
+
 // Take receives a string containing all acceptable characters and will take the next rune
 // if it matches an acceptable character
 func (l *L) Take(chars string) bool {
@@ -186,20 +924,151 @@ func (l *L) Take(chars string) bool {
 	return false
 }
 
+// TakeOrError works like Take, but rather than backing up over a rune that is
+// not in chars it takes it and emits it as an ErrorToken of its own, recording
+// the error without stopping the lexer, so lexing carries on through invalid
+// input. If the analyzed section is not empty it is first emitted as a token of
+// type t, so the ErrorToken only spans the unexpected rune. It returns false
+// whenever the next rune is not in chars, including at EOF, where nothing is
+// emitted.
+func (l *L) TakeOrError(chars string, t TokenType) bool {
+	if l.Take(chars) {
+		return true
+	}
+	if l.Peek() == rune(EOFToken) {
+		return false
+	}
+	l.EmitNonEmpty(t)
+	e := fmt.Sprintf("unexpected %q", l.Next())
+	l.record(e)
+	l.emitError(e)
+	l.Ignore()
+	return false
+}
+
+// AcceptRune will take the next rune if it is r
+func (l *L) AcceptRune(r rune) bool {
+	if l.Next() == r {
+		return true
+	}
+	l.Backup()
+	return false
+}
+
+// ExpectRune will take the next rune if it is r, and otherwise reports the
+// mismatch through Errorf, such as "expected '}' but got ';'", and returns false.
+func (l *L) ExpectRune(r rune) bool {
+	if l.AcceptRune(r) {
+		return true
+	}
+	if next := l.Peek(); next == rune(EOFToken) {
+		l.Errorf("expected %q but got EOF", r)
+	} else {
+		l.Errorf("expected %q but got %q", r, next)
+	}
+	return false
+}
+
+// AcceptAnyOf will take the next rune if it is one of runes
+func (l *L) AcceptAnyOf(runes []rune) bool {
+	r := l.Next()
+	if r != rune(EOFToken) && slices.Contains(runes, r) {
+		return true
+	}
+	l.Backup()
+	return false
+}
+
+// AcceptRunOf will continue over each rune until it finds one that is not one of
+// runes, and returns the number of runes taken
+func (l *L) AcceptRunOf(runes []rune) int {
+	return l.TakeWhile(func(r rune) bool {
+		return slices.Contains(runes, r)
+	})
+}
+
+// AcceptRange will take the next rune if it is between lo and hi, inclusive
+func (l *L) AcceptRange(lo, hi rune) bool {
+	if r := l.Next(); r >= lo && r <= hi && r != rune(EOFToken) {
+		return true
+	}
+	l.Backup()
+	return false
+}
+
+// AcceptRunRange will continue over each rune until it finds one that is not
+// between lo and hi, inclusive, and returns the number of runes taken
+func (l *L) AcceptRunRange(lo, hi rune) int {
+	return l.TakeWhile(func(r rune) bool {
+		return r >= lo && r <= hi
+	})
+}
+
+// TakeFold works like Take but matches the next rune against the acceptable
+// characters under Unicode simple case folding, so "a" also takes 'A'
+func (l *L) TakeFold(chars string) bool {
+	r := l.Next()
+	if r != rune(EOFToken) {
+		for _, c := range chars {
+			for f := c; ; {
+				if f == r {
+					return true
+				}
+				if f = unicode.SimpleFold(f); f == c {
+					break
+				}
+			}
+		}
+	}
+	l.Backup()
+	return false
+}
+
 // TakeMany receives a string containing all acceptable characters and will continue
 // over each rune until it finds an unacceptable rune
 func (l *L) TakeMany(chars string) {
-	r := l.Next()
-	for strings.ContainsRune(chars, r) {
-		r = l.Next()
+	l.AcceptRun(chars)
+}
+
+// AcceptRun works like TakeMany but returns the number of runes taken
+func (l *L) AcceptRun(chars string) int {
+	return l.TakeWhile(func(r rune) bool {
+		return strings.ContainsRune(chars, r)
+	})
+}
+
+// CountMatching returns the number of upcoming runes that are in chars, without
+// moving the Position or touching the Rewind stack.
+func (l *L) CountMatching(chars string) int {
+	n := 0
+	for pos := l.Position; ; n++ {
+		r, w := l.decode(pos)
+		if w == 0 || !strings.ContainsRune(chars, r) {
+			return n
+		}
+		pos += w
+	}
+}
+
+// TakeMinMax takes at most max runes from the acceptable characters. If fewer than
+// min of them come next, it backs up all of them and returns false
+func (l *L) TakeMinMax(chars string, min, max int) bool {
+	n := 0
+	for n < max && l.Take(chars) {
+		n++
+	}
+	if n < min {
+		l.BackupMany(n)
+		return false
 	}
-	l.Backup() // last next wasn't a match
+	return true
 }
 
-// TakePattern receives a regex pattern and will take the next rune if it matches the pattern
+// TakePattern receives a regex pattern and will take the next rune if it matches the pattern.
+// EOF never matches, even for patterns that would match its string form.
 func (l *L) TakePattern(p *regexp.Regexp) bool {
 	r := l.Next()
-	if p.MatchString(string(r)) {
+	if r != rune(EOFToken) && p.MatchString(string(r)) {
 		return true
 	}
 	l.Backup()
@@ -207,18 +1076,358 @@ func (l *L) TakePattern(p *regexp.Regexp) bool {
 }
 
 // TakeManyPattern receives a regex pattern and will continue over each rune until
-// a non-match is found
+// a non-match or EOF is found
 func (l *L) TakeManyPattern(p *regexp.Regexp) {
 	r := l.Next()
-	for p.MatchString(string(r)) {
+	for r != rune(EOFToken) && p.MatchString(string(r)) {
+		r = l.Next()
+	}
+	l.Backup()
+}
+
+// CollectTokens runs the lexer to completion and returns every token it produced,
+// ending with an EOFToken, along with the error that stopped it, if any.
+func (l *L) CollectTokens() ([]Token, error) {
+	var tokens []Token
+	l.RunLexerFunc(func(tok Token) error {
+		tokens = append(tokens, tok)
+		return nil
+	})
+	if len(tokens) == 0 || tokens[len(tokens)-1].Type != EOFToken {
+		tokens = append(tokens, l.eof())
+	}
+	return tokens, l.Err
+}
+
+// Validate runs the lexer, discarding its tokens, and returns the first error
+// reported while lexing, or the error that stopped it if none was. It stops at
+// the first ErrorToken, returning its value as the error if it was emitted
+// directly rather than through Error. Errors reported through Error count even
+// when an ErrorHandler is set. It returns nil if the whole input lexed cleanly.
+func (l *L) Validate() error {
+	var first error
+	l.RunLexerFunc(func(tok Token) error {
+		if tok.Type == ErrorToken && first == nil {
+			if len(l.errs) > 0 {
+				first = l.errs[0]
+			} else {
+				first = errors.New(tok.Value)
+			}
+		}
+		return first
+	})
+	if first != nil {
+		return first
+	}
+	if len(l.errs) > 0 {
+		return l.errs[0]
+	}
+	return l.Err
+}
+
+// Sublex runs a separate lexer starting at initial over the Input between the
+// byte offsets start and end, and returns the tokens it produced. Their
+// positions are given in terms of the whole Input rather than the sub-range, so
+// they can be spliced into this lexer's own stream. A lexer reading from an
+// io.RuneReader only keeps the input since its last Emit or Ignore, so Sublex
+// returns nil for a range outside of that.
+func (l *L) Sublex(start, end int, initial StateFunc) []Token {
+	if l.reader != nil && (start < l.base || end > l.end()) {
+		return nil
+	}
+	line, column, runes := l.locate(start)
+	return lexAt(l.slice(start, end), initial, Token{
+		Start:     start,
+		Line:      line,
+		Column:    column,
+		RuneStart: runes,
+	})
+}
+
+// Relex runs a separate lexer starting at initial over the value of tok, such
+// as the body of a string token lexed in a first pass, and returns the tokens it
+// produced. Their positions are rebased onto those of tok, so they refer to the
+// original input. This only holds if the value of tok is the section of the
+// input it spans, unchanged.
+func Relex(tok Token, initial StateFunc) []Token {
+	return lexAt(tok.Value, initial, tok)
+}
+
+// lexAt lexes src starting at initial, offsetting the positions of the tokens
+// produced by the position at which at begins. It runs the lexer on the calling
+// goroutine, so it can be used from a lexer driven by NextPull.
+func lexAt(src string, initial StateFunc, at Token) []Token {
+	var tokens []Token
+	New(src, initial).RunLexerFunc(func(tok Token) error {
+		if tok.Line == 1 {
+			tok.Column += at.Column - 1
+		}
+		tok.Line += at.Line - 1
+		tok.Start += at.Start
+		tok.End += at.Start
+		tok.RuneStart += at.RuneStart
+		tok.RuneEnd += at.RuneStart
+		tokens = append(tokens, tok)
+		return nil
+	})
+	return tokens
+}
+
+// All returns an iterator over the tokens produced by the lexer, starting it
+// asynchronously if it has not been started yet. When the lexer is started by
+// All, breaking out of the loop early cancels it so its goroutine exits.
+func (l *L) All() iter.Seq[Token] {
+	return func(yield func(Token) bool) {
+		if l.Tokens == nil {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			l.RunLexerContext(ctx)
+		}
+		for tok := range l.Tokens {
+			if !yield(tok) {
+				return
+			}
+		}
+	}
+}
+
+// PushState saves a state on the StateRecord so it can be resumed later with
+// PopState or ReturnState, for instance after lexing a nested construct.
+func (l *L) PushState(f StateFunc) {
+	l.StateRecord.Push(f)
+}
+
+// PopState removes and returns the most recently pushed state. If the
+// StateRecord is empty it returns nil, which ends the lexer when returned from
+// a state function.
+func (l *L) PopState() StateFunc {
+	return l.StateRecord.Pop()
+}
+
+// ReturnState pops the most recently pushed state so that a state function can
+// resume it with `return l.ReturnState()`. Like PopState it returns nil, ending
+// the lexer, when no state has been pushed.
+func (l *L) ReturnState() StateFunc {
+	return l.PopState()
+}
+
+// TakeCategory will take the next rune if it belongs to any of the given Unicode
+// range tables, such as unicode.Letter or unicode.Digit
+func (l *L) TakeCategory(cats ...*unicode.RangeTable) bool {
+	r := l.Next()
+	if r != rune(EOFToken) && unicode.IsOneOf(cats, r) {
+		return true
+	}
+	l.Backup()
+	return false
+}
+
+// TakeManyCategory will continue over each rune until it finds one that does not
+// belong to any of the given Unicode range tables
+func (l *L) TakeManyCategory(cats ...*unicode.RangeTable) {
+	l.TakeWhile(func(r rune) bool {
+		return unicode.IsOneOf(cats, r)
+	})
+}
+
+// LookingAt matches p against the upcoming input and, if a match begins at the
+// current Position, takes it and returns the matched text. Matches that begin
+// later are rejected, but anchoring p with \A avoids searching for them. p is
+// matched against the raw input, and with NormalizeNewlines a match that ends
+// between the '\r' and '\n' of a "\r\n" is rejected, since the pair is read as
+// one character.
+func (l *L) LookingAt(p *regexp.Regexp) (string, bool) {
+	var loc []int
+	switch {
+	case !l.fromBytes:
+		loc = p.FindStringIndex(l.Input[l.Position:])
+	case l.reader == nil:
+		loc = p.FindIndex(l.buf[l.Position-l.base:])
+	default:
+		loc = p.FindReaderIndex(&inputReader{l: l, pos: l.Position})
+	}
+	if loc == nil || loc[0] != 0 {
+		return "", false
+	}
+	start, end := l.Position, l.Position+loc[1]
+	if l.NormalizeNewlines && end > start {
+		if r, _ := l.decodeRune(end - 1); r == '\r' {
+			if next, _ := l.decodeRune(end); next == '\n' {
+				return "", false
+			}
+		}
+	}
+	for l.Position < end {
+		l.Next()
+	}
+	return l.slice(start, end), true
+}
+
+// AcceptSequence takes whichever of the given literals comes next, trying the
+// longest first so that "<=" is preferred over "<", and returns the one taken
+func (l *L) AcceptSequence(options ...string) (string, bool) {
+	sorted := slices.Clone(options)
+	slices.SortStableFunc(sorted, func(a, b string) int {
+		return len(b) - len(a)
+	})
+	for _, o := range sorted {
+		if l.AcceptString(o) {
+			return o, true
+		}
+	}
+	return "", false
+}
+
+// TakeWhile will continue over each rune for as long as pred returns true, stopping
+// before the first rune it rejects or EOF. It returns the number of runes taken,
+// which is also the number of entries it leaves on the Rewind stack.
+func (l *L) TakeWhile(pred func(rune) bool) int {
+	n := 0
+	r := l.Next()
+	for r != rune(EOFToken) && pred(r) {
+		n++
 		r = l.Next()
 	}
 	l.Backup()
+	return n
+}
+
+// TakeUntil will continue over each rune until pred returns true, stopping before
+// the first rune it accepts or EOF. It returns the number of runes taken.
+func (l *L) TakeUntil(pred func(rune) bool) int {
+	return l.TakeWhile(func(r rune) bool {
+		return !pred(r)
+	})
+}
+
+// SkipWhitespace takes every upcoming rune for which unicode.IsSpace is true and
+// then ignores them
+func (l *L) SkipWhitespace() {
+	l.TakeWhile(unicode.IsSpace)
+	l.Ignore()
+}
+
+// SkipWhitespaceNoNewline works like SkipWhitespace but stops at a newline, for
+// grammars in which newlines are significant
+func (l *L) SkipWhitespaceNoNewline() {
+	l.TakeWhile(func(r rune) bool {
+		return r != '\n' && unicode.IsSpace(r)
+	})
+	l.Ignore()
+}
+
+// AcceptString takes the upcoming runes if they exactly match s, leaving the
+// Position untouched otherwise
+func (l *L) AcceptString(s string) bool {
+	if !l.hasPrefix(s) {
+		return false
+	}
+	for range s {
+		l.Next()
+	}
+	return true
+}
+
+// AcceptUntilString takes runes until the upcoming input starts with term, leaving
+// the Position just before it. If EOF comes first it takes the rest of the input
+// and returns false
+func (l *L) AcceptUntilString(term string) bool {
+	for !l.hasPrefix(term) {
+		if l.Next() == rune(EOFToken) {
+			l.Backup()
+			return false
+		}
+	}
+	return true
+}
+
+// TakeDelimited takes the rest of a delimited section such as a quoted string,
+// up to and including the first close not preceded by escape, and returns the
+// content between the delimiters. Within the content, escape followed by close
+// or by escape stands for that rune alone, and other escape sequences are kept
+// as they are for the caller to interpret. The opening delimiter open must
+// already have been consumed. If EOF comes before close it takes the rest of
+// the input and returns false.
+func (l *L) TakeDelimited(open, close, escape rune) (string, bool) {
+	var b strings.Builder
+	for {
+		r := l.Next()
+		switch r {
+		case rune(EOFToken):
+			l.Backup()
+			return b.String(), false
+		case close:
+			return b.String(), true
+		case escape:
+			next := l.Next()
+			if next == rune(EOFToken) {
+				l.Backup()
+				b.WriteRune(r)
+				return b.String(), false
+			}
+			if next != close && next != escape {
+				b.WriteRune(r)
+			}
+			b.WriteRune(next)
+		default:
+			b.WriteRune(r)
+		}
+	}
+}
+
+// TakeBalanced takes the rest of a section enclosed by open and close, such as a
+// parenthesized group, up to and including the close that balances the opening
+// delimiter, and returns the raw text between them. Nested pairs of open and
+// close are taken along with the rest, unless open and close are the same rune,
+// in which case the section ends at the next one. The opening delimiter must
+// already have been consumed. If EOF comes before the section is balanced it
+// takes the rest of the input and returns false.
+func (l *L) TakeBalanced(open, close rune) (string, bool) {
+	start := l.Position
+	for depth := 1; ; {
+		at := l.Position
+		switch l.Next() {
+		case rune(EOFToken):
+			l.Backup()
+			return l.slice(start, l.Position), false
+		case close:
+			if depth--; depth == 0 {
+				return l.slice(start, at), true
+			}
+		case open:
+			depth++
+		}
+	}
+}
+
+// SkipNestedComment skips a block comment delimited by open and close in which
+// comments may nest, such as `/* a /* b */ c */`, taking it up to and including
+// the close that balances the opening marker and then ignoring it. The opening
+// marker must already have been consumed. If EOF comes before the comment is
+// balanced it takes the rest of the input without ignoring it, so an error can
+// be reported for it, and returns false.
+func (l *L) SkipNestedComment(open, close string) bool {
+	for depth := 1; depth > 0; {
+		switch {
+		case l.AcceptString(close):
+			depth--
+		case l.AcceptString(open):
+			depth++
+		case l.Next() == rune(EOFToken):
+			l.Backup()
+			return false
+		}
+	}
+	l.Ignore()
+	return true
 }
 
 // NextToken returns the next token from the lexer and a value to denote whether
 // or not the token is finished.
 func (l *L) NextToken() (*Token, bool) {
+	if tok, ok := l.shift(); ok {
+		return &tok, false
+	}
 	if tok, ok := <-l.Tokens; ok {
 		return &tok, false
 	} else {
@@ -226,23 +1435,611 @@ func (l *L) NextToken() (*Token, bool) {
 	}
 }
 
+// TryNextToken works like NextToken but never blocks. It returns the next token
+// and true if one is ready, and otherwise reports whether the lexer is finished,
+// telling a token that is not ready yet apart from the end of the stream.
+func (l *L) TryNextToken() (tok *Token, ok bool, done bool) {
+	if tok, ok := l.shift(); ok {
+		return &tok, true, false
+	}
+	select {
+	case tok, ok := <-l.Tokens:
+		if !ok {
+			return nil, false, true
+		}
+		return &tok, true, false
+	default:
+		return nil, false, false
+	}
+}
+
+// Filter returns a channel that receives the tokens from the Tokens channel for
+// which keep returns true, starting the lexer asynchronously if it has not been
+// started yet. The returned channel is closed once the Tokens channel is.
+func (l *L) Filter(keep func(Token) bool) <-chan Token {
+	if l.Tokens == nil {
+		l.RunLexer()
+	}
+	filtered := make(chan Token, cap(l.Tokens))
+	go func(tokens <-chan Token) {
+		defer close(filtered)
+		for tok := range tokens {
+			if keep(tok) {
+				filtered <- tok
+			}
+		}
+	}(l.Tokens)
+	return filtered
+}
+
+// Drain receives and discards the remaining tokens until the Tokens channel is
+// closed, letting a lexer started with RunLexer finish.
+func (l *L) Drain() {
+	if l.Tokens == nil {
+		return
+	}
+	for range l.Tokens {
+	}
+}
+
+// NextTokenErr returns the next token from the lexer. Once the lexer is finished
+// it returns a nil token along with the error that stopped it, if any.
+func (l *L) NextTokenErr() (*Token, error) {
+	if tok, done := l.NextToken(); !done {
+		return tok, nil
+	}
+	return nil, l.Err
+}
+
+// Unshift queues tok to be delivered exactly as it is ahead of the tokens lexed
+// after it, for example to inject the expansion of a macro. Called from a state
+// function, tok takes its place in the stream between the tokens emitted before
+// and after the call. Called by the consumer, it is delivered by the next call
+// to NextToken, TryNextToken, NextBatch or NextPull ahead of the tokens not yet
+// received, or else ahead of the next token the lexer emits, so consumers such
+// as All and CollectTokens see it too. A consumer calling Unshift while the
+// lexer runs a state function on another goroutine may see tok after tokens
+// the lexer had already emitted.
+func (l *L) Unshift(tok Token) {
+	l.unshifted.Lock()
+	defer l.unshifted.Unlock()
+	l.unshifted.tokens = append(l.unshifted.tokens, queuedToken{tok, l.stepping.Load()})
+	l.unshifted.n.Add(1)
+}
+
+// NextBatch returns up to max tokens from the lexer in one call. It blocks until
+// at least one token is available, then takes whatever else is already buffered
+// on the Tokens channel without waiting for a full batch. Once the lexer is
+// finished and every token has been returned, it returns an empty slice.
+func (l *L) NextBatch(max int) []Token {
+	if max <= 0 {
+		return nil
+	}
+	batch := make([]Token, 0, max)
+	for len(batch) < max {
+		tok, ok := l.shift()
+		if !ok {
+			break
+		}
+		batch = append(batch, tok)
+	}
+	if len(batch) == 0 {
+		tok, ok := <-l.Tokens
+		if !ok {
+			return nil
+		}
+		batch = append(batch, tok)
+	}
+	for len(batch) < max {
+		select {
+		case tok, ok := <-l.Tokens:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, tok)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
 // Partial yyLexer implementation
 
+// Error records e in Err and passes it to the ErrorHandler. Without an
+// ErrorHandler, an ErrorToken carrying e is emitted instead and the lexer stops
+// once the current state function returns.
 func (l *L) Error(e string) {
+	l.record(e)
 	if l.ErrorHandler != nil {
-		l.Err = errors.New(e)
 		l.ErrorHandler(e)
 	} else {
-		panic(e)
+		l.emitError(e)
+		l.stopped, l.recoverable = true, true
+	}
+}
+
+// RecoverTo lets the lexer carry on after an error reported through Error, for
+// reporting several errors in one pass. It takes runes up to, but not including,
+// the next one for which sync returns true, such as a newline or a semicolon,
+// and ignores them, so the state function returned next continues from there.
+// Errors that stop the lexer for other reasons, such as MaxTokens being
+// exceeded, are not recovered from.
+func (l *L) RecoverTo(sync func(rune) bool) {
+	if l.recoverable {
+		l.stopped, l.recoverable = false, false
+	}
+	l.TakeUntil(sync)
+	l.Ignore()
+}
+
+// Errors returns every error reported through Error, EmitError and Errorf, in
+// the order they were reported. Err holds the last of them.
+func (l *L) Errors() []error {
+	return l.errs
+}
+
+// EmitError formats an error message, records it in Err and emits it as an
+// ErrorToken whether or not an ErrorHandler is set. It returns nil so a state
+// function can report an error and end the lexer with
+// `return l.EmitError("bad rune %q", r)`.
+func (l *L) EmitError(format string, args ...any) StateFunc {
+	e := fmt.Sprintf(format, args...)
+	l.record(e)
+	l.emitError(e)
+	return nil
+}
+
+// Stop ends the lexer once the current state function returns, whatever state
+// function it returns, without reporting an error. It returns nil so a state
+// function can end lexing with `return l.Stop()`, and can also be called from a
+// helper deep inside a state function.
+func (l *L) Stop() StateFunc {
+	l.stopped, l.recoverable = true, false
+	return nil
+}
+
+// Errorf formats an error message, prefixes it with the current line and
+// column and reports it through Error, for example
+// "line 3:12: unexpected character '}'".
+func (l *L) Errorf(format string, args ...any) {
+	l.Error(fmt.Sprintf("line %d:%d: ", l.Line, l.Column) + fmt.Sprintf(format, args...))
+}
+
+// Checkpoint is a snapshot of the state of a lexer taken by L.Checkpoint.
+type Checkpoint struct {
+	start, position        int
+	line, column           int
+	startLine, startColumn int
+	runeStart, runePos     int
+	rewind                 []rune
+	states                 stateStack
+	ignored                []byteRange
+	backtracked            int
+}
+
+// Checkpoint takes a snapshot of the lexer's positions and stacks so a state
+// function can lex speculatively and go back with Restore if it fails.
+func (l *L) Checkpoint() Checkpoint {
+	return Checkpoint{
+		start:       l.Start,
+		position:    l.Position,
+		line:        l.Line,
+		column:      l.Column,
+		startLine:   l.startLine,
+		startColumn: l.startColumn,
+		runeStart:   l.runeStart,
+		runePos:     l.runePos,
+		rewind:      append([]rune(nil), l.Rewind.runes...),
+		states:      l.StateRecord,
+		ignored:     append([]byteRange(nil), l.ignored...),
+		backtracked: l.backtracked,
 	}
 }
 
+// Restore returns the lexer to the state saved in cp. Tokens emitted since the
+// checkpoint was taken are not taken back, and a lexer reading from an
+// io.RuneReader can only be restored to a checkpoint taken since its last Emit
+// or Ignore. The runes gone back over count towards MaxBacktrack.
+func (l *L) Restore(cp Checkpoint) {
+	back := l.runePos - cp.runePos
+	l.Start, l.Position = cp.start, cp.position
+	l.Line, l.Column = cp.line, cp.column
+	l.startLine, l.startColumn = cp.startLine, cp.startColumn
+	l.runeStart, l.runePos = cp.runeStart, cp.runePos
+	l.Rewind.runes = append(l.Rewind.runes[:0], cp.rewind...)
+	l.StateRecord = cp.states
+	l.ignored = append(l.ignored[:0], cp.ignored...)
+	l.publish()
+	l.reach = max(l.reach, l.Position)
+	l.backtracked = max(l.backtracked, cp.backtracked)
+	l.backtrack(max(back, 0))
+}
+
 // Private methods
 
+// makeTokens creates the Tokens channel for a new run of the lexer, buffered by
+// BufferSize if it is set.
+func (l *L) makeTokens() {
+	l.restart()
+	l.sink = nil
+	buffSize := l.BufferSize
+	if buffSize <= 0 {
+		// Take half the input length as a buffer size.
+		buffSize = (len(l.Input) + len(l.buf)) / 2
+	}
+	if buffSize <= 0 {
+		buffSize = 1
+	}
+	l.Tokens = make(chan Token, buffSize)
+}
+
+// restart clears what is left of a previous run of the lexer, such as the
+// errors it reported and whether it was stopped, so it can be run again from
+// the current Position, for example after a Seek.
+func (l *L) restart() {
+	l.started, l.finished = false, false
+	l.stopped, l.recoverable = false, false
+	l.count = 0
+	l.last, l.hasLast = Token{}, false
+	l.Err, l.errs = nil, nil
+}
+
+// send pushes a token into the Tokens channel, giving up if the lexer's
+// context is done first. Tokens queued by Unshift are pushed ahead of it.
+func (l *L) send(tok Token) {
+	l.flush()
+	l.deliver(tok)
+}
+
+// flush delivers every token queued by Unshift, in the order they were queued.
+func (l *L) flush() {
+	if l.unshifted.n.Load() == 0 {
+		return
+	}
+	l.unshifted.Lock()
+	queued := l.unshifted.tokens
+	l.unshifted.tokens = nil
+	l.unshifted.n.Store(0)
+	l.unshifted.Unlock()
+	for _, q := range queued {
+		l.deliver(q.tok)
+	}
+}
+
+// deliver pushes a token into the Tokens channel, or passes it to the sink.
+func (l *L) deliver(tok Token) {
+	if l.sink != nil {
+		if err := l.sink(tok); err != nil {
+			l.Err = err
+			l.stopped = true
+		}
+		return
+	}
+	if l.ctx == nil {
+		l.Tokens <- tok
+		return
+	}
+	select {
+	case l.Tokens <- tok:
+	case <-l.ctx.Done():
+		l.Err = l.ctx.Err()
+	}
+}
+
+// shift removes and returns the first token queued by Unshift from outside of
+// a state function, and false if there is none. Tokens queued from a state
+// function are left for the lexer to deliver in emit order.
+func (l *L) shift() (Token, bool) {
+	if l.unshifted.n.Load() == 0 {
+		return Token{}, false
+	}
+	l.unshifted.Lock()
+	defer l.unshifted.Unlock()
+	for i, q := range l.unshifted.tokens {
+		if !q.inline {
+			l.unshifted.tokens = slices.Delete(l.unshifted.tokens, i, i+1)
+			l.unshifted.n.Add(-1)
+			return q.tok, true
+		}
+	}
+	return Token{}, false
+}
+
+// buffer is the sink for lexers driven by NextPull.
+func (l *L) buffer(tok Token) error {
+	l.pending = append(l.pending, tok)
+	return nil
+}
+
+// emitError pushes an ErrorToken carrying e for the current analyzed section of
+// the Input.
+func (l *L) emitError(e string) {
+	l.send(l.token(ErrorToken, e))
+}
+
+// fail records e in Err, emits it as an ErrorToken and stops the lexer.
+func (l *L) fail(e string) {
+	l.record(e)
+	l.emitError(e)
+	l.stopped = true
+}
+
+// record sets Err to a LexError for e and adds it to the errors returned by
+// Errors.
+func (l *L) record(e string) {
+	l.Err = l.newError(e)
+	l.errs = append(l.errs, l.Err)
+}
+
+// backtrack counts n runes being backed up over, stopping the lexer once that
+// takes it past MaxBacktrack.
+func (l *L) backtrack(n int) {
+	l.backtracked += n
+	if l.MaxBacktrack > 0 && l.backtracked > l.MaxBacktrack && !l.stopped {
+		l.fail(fmt.Sprintf("backtracking limit of %d exceeded", l.MaxBacktrack))
+	}
+}
+
+// eof returns an EOFToken positioned where the lexer ended.
+func (l *L) eof() Token {
+	return Token{
+		Type:      EOFToken,
+		Start:     l.Position,
+		End:       l.Position,
+		Line:      l.Line,
+		Column:    l.Column,
+		RuneStart: l.runePos,
+		RuneEnd:   l.runePos,
+	}
+}
+
+// current returns a token with the given type holding the current analyzed
+// value, leaving the value to be resolved later if LazyValues or NoValues is set
+// and there is no OnEmit to see it.
+func (l *L) current(t TokenType) Token {
+	if !(l.LazyValues || l.NoValues) || l.OnEmit != nil || len(l.ignored) > 0 || l.Position <= l.Start {
+		return l.token(t, l.Current())
+	}
+	tok := l.token(t, "")
+	tok.lazy = true
+	return tok
+}
+
+// token returns a token with the given type and value spanning the current
+// analyzed section of the Input.
+func (l *L) token(t TokenType, value string) Token {
+	return Token{
+		Type:      t,
+		Value:     value,
+		Start:     l.Start,
+		End:       l.Position,
+		Line:      l.startLine,
+		Column:    l.startColumn,
+		RuneStart: l.runeStart,
+		RuneEnd:   l.runePos,
+	}
+}
+
+// emit pushes tok into the Tokens channel, remembers it as the last token and
+// moves on to the next one.
+func (l *L) emit(tok Token) {
+	if l.MaxTokens > 0 && l.count >= l.MaxTokens {
+		if !l.stopped {
+			l.fail(fmt.Sprintf("token limit of %d exceeded", l.MaxTokens))
+		}
+		return
+	}
+	if tok.Type != ErrorToken && tok.Type != EOFToken {
+		l.count++
+		if l.OnEmit != nil {
+			l.OnEmit(&tok)
+		}
+	}
+	l.send(tok)
+	l.last, l.hasLast = tok, true
+	l.advanceStart()
+}
+
+// advanceStart moves the beginning of the next token up to Position and
+// clears the Rewind stack.
+func (l *L) advanceStart() {
+	l.Start = l.Position
+	l.observed.start.Store(int64(l.Start))
+	l.startLine, l.startColumn = l.Line, l.Column
+	l.runeStart = l.runePos
+	l.backtracked, l.reach = 0, l.Position
+	l.Rewind.Clear()
+	l.ignored = l.ignored[:0]
+	if l.reader != nil {
+		l.buf = l.buf[l.Start-l.base:]
+		l.base = l.Start
+	}
+}
+
+// publish stores Start and Position for AtomicStart and AtomicPosition. Next
+// and Backup leave Start alone, so they store only Position, and advanceStart
+// only Start.
+func (l *L) publish() {
+	l.observed.start.Store(int64(l.Start))
+	l.observed.position.Store(int64(l.Position))
+}
+
+// decode returns the rune beginning at byte offset pos along with its width,
+// or EOFToken and a width of 0 at the end of the input. With NormalizeNewlines
+// set, "\r\n" is returned as a single '\n' two bytes wide.
+func (l *L) decode(pos int) (rune, int) {
+	r, w := l.decodeRune(pos)
+	if r == '\r' && l.NormalizeNewlines {
+		if next, _ := l.decodeRune(pos + w); next == '\n' {
+			return '\n', 2
+		}
+	}
+	return r, w
+}
+
+// decodeRune returns the rune beginning at byte offset pos along with its
+// width, like decode but without normalizing newlines. Lexers reading from an
+// io.RuneReader buffer as many runes as needed to reach pos.
+func (l *L) decodeRune(pos int) (rune, int) {
+	if !l.fromBytes {
+		if pos >= len(l.Input) {
+			return rune(EOFToken), 0
+		}
+		return utf8.DecodeRuneInString(l.Input[pos:])
+	}
+	i := pos - l.base
+	for l.reader != nil && i >= len(l.buf) {
+		r, _, err := l.reader.ReadRune()
+		if err != nil {
+			if err != io.EOF {
+				l.Err = err
+			}
+			return rune(EOFToken), 0
+		}
+		var b [utf8.UTFMax]byte
+		l.buf = append(l.buf, b[:utf8.EncodeRune(b[:], r)]...)
+	}
+	if i >= len(l.buf) {
+		return rune(EOFToken), 0
+	}
+	return utf8.DecodeRune(l.buf[i:])
+}
+
+// decodeLast returns the rune ending at byte offset pos along with its width,
+// or EOFToken and a width of 0 at the start of the input, normalizing newlines
+// like decode. Lexers reading from an io.RuneReader can only look back to the
+// last Emit or Ignore.
+func (l *L) decodeLast(pos int) (rune, int) {
+	var r rune
+	var w int
+	switch {
+	case !l.fromBytes && pos > 0:
+		r, w = utf8.DecodeLastRuneInString(l.Input[:pos])
+	case l.fromBytes && pos > l.base:
+		r, w = utf8.DecodeLastRune(l.buf[:pos-l.base])
+	default:
+		return rune(EOFToken), 0
+	}
+	if r == '\n' && l.NormalizeNewlines {
+		if prev, _ := l.decodeLast(pos - w); prev == '\r' {
+			return '\n', 2
+		}
+	}
+	return r, w
+}
+
+// hasPrefix returns whether the upcoming input starts with s.
+func (l *L) hasPrefix(s string) bool {
+	pos := l.Position
+	for _, want := range s {
+		r, w := l.decode(pos)
+		if w == 0 || r != want {
+			return false
+		}
+		pos += w
+	}
+	return true
+}
+
+// end returns the byte offset of the end of the input, reading the rest of it
+// into memory for a lexer reading from an io.RuneReader.
+func (l *L) end() int {
+	if !l.fromBytes {
+		return len(l.Input)
+	}
+	for l.reader != nil {
+		if _, w := l.decode(l.base + len(l.buf)); w == 0 {
+			break
+		}
+	}
+	return l.base + len(l.buf)
+}
+
+// slice returns the input between the byte offsets start and end.
+func (l *L) slice(start, end int) string {
+	if !l.fromBytes {
+		return l.Input[start:end]
+	}
+	return string(l.buf[start-l.base : end-l.base])
+}
+
+// locate returns the line, column and rune offset of the byte offset pos,
+// counting from the start of the pending token when pos is not before it.
+func (l *L) locate(pos int) (line, column, runes int) {
+	from := 0
+	line, column = 1, 1
+	if pos >= l.Start {
+		from = l.Start
+		line, column, runes = l.startLine, l.startColumn, l.runeStart
+	}
+	cur := l.slice(from, pos)
+	for i, r := range cur {
+		switch {
+		case r == '\n':
+			line++
+			column = 1
+		case r == '\r' && l.NormalizeNewlines && strings.HasPrefix(cur[i+1:], "\n"):
+			continue
+		case from+i == 0 && l.bom:
+		default:
+			column = l.nextColumn(column, r)
+		}
+		runes++
+	}
+	return line, column, runes
+}
+
+// column recomputes the column of Position from the start of the pending
+// token, which is required after backing up over a newline or a tab.
+func (l *L) column() int {
+	cur := l.slice(l.Start, l.Position)
+	column := l.startColumn
+	if i := strings.LastIndexByte(cur, '\n'); i >= 0 {
+		cur, column = cur[i+1:], 1
+	}
+	for _, r := range cur {
+		column = l.nextColumn(column, r)
+	}
+	return column
+}
+
+// nextColumn returns the column following a rune other than a newline read at
+// column, advancing to the next tab stop for a tab if TabWidth is set.
+func (l *L) nextColumn(column int, r rune) int {
+	if r == '\t' && l.TabWidth > 1 {
+		return column + l.TabWidth - (column-1)%l.TabWidth
+	}
+	return column + 1
+}
+
 func (l *L) run() {
-	state := l.StartState
-	for state != nil {
-		state = state(l)
+	for l.Step() {
+	}
+}
+
+// step runs the current state function.
+func (l *L) step() {
+	defer l.recoverPanic()
+	if l.StateHook != nil {
+		l.StateHook(stateName(l.state), l.Position)
+	}
+	l.state = l.state(l)
+}
+
+// stateName returns the name of the function behind a state.
+func stateName(f StateFunc) string {
+	if fn := runtime.FuncForPC(reflect.ValueOf(f).Pointer()); fn != nil {
+		return fn.Name()
+	}
+	return "unknown"
+}
+
+// recoverPanic reports a panic from a state function through Error so that the
+// Tokens channel is still closed and consumers are not left waiting.
+func (l *L) recoverPanic() {
+	if r := recover(); r != nil {
+		l.Error(fmt.Sprintf("panic: %v", r))
+		l.state = nil
 	}
-	close(l.Tokens)
 }
@@ -1,14 +1,19 @@
 package lexer_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"regexp"
+	"strings"
 	"testing"
+	"unicode"
 
 	"github.com/ZadenRB/go-lexer"
 )
 
 const (
-	NumberToken lexer.TokenType = iota
+	NumberToken lexer.TokenType = lexer.FirstUserToken + iota
 	OpToken
 	IdentToken
 )
@@ -176,6 +181,71 @@ func Test_MultipleTokens(t *testing.T) {
 	}
 }
 
+func Test_LexingFromReader(t *testing.T) {
+	cases := []struct {
+		tokType lexer.TokenType
+		val     string
+		start   int
+	}{
+		{NumberToken, "123", 0},
+		{OpToken, ".", 3},
+		{IdentToken, "hello", 4},
+		{NumberToken, "675", 11},
+	}
+
+	l := lexer.NewFromReader(strings.NewReader("123.hello  675"), NumberState)
+	l.RunLexer()
+
+	for _, c := range cases {
+		tok, done := l.NextToken()
+		if done {
+			t.Error("Expected there to be more tokens, but there weren't")
+			return
+		}
+
+		if c.tokType != tok.Type {
+			t.Errorf("Expected token type %v but got %v", c.tokType, tok.Type)
+			return
+		}
+
+		if c.val != tok.Value {
+			t.Errorf("Expected %q but got %q", c.val, tok.Value)
+			return
+		}
+
+		if c.start != tok.Start {
+			t.Errorf("Expected token to start at %d but got %d", c.start, tok.Start)
+			return
+		}
+	}
+
+	if _, done := l.NextToken(); !done {
+		t.Error("Expected the lexer to be done, but it wasn't.")
+		return
+	}
+}
+
+func Test_LexingFromBytes(t *testing.T) {
+	tokens, err := lexer.NewFromBytes([]byte("123.hello  675"), NumberState).CollectTokens()
+	if err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+		return
+	}
+
+	cases := []string{"123", ".", "hello", "675", ""}
+	if len(tokens) != len(cases) {
+		t.Errorf("Expected %d tokens but got %d", len(cases), len(tokens))
+		return
+	}
+
+	for i, c := range cases {
+		if c != tokens[i].Value {
+			t.Errorf("Expected %q but got %q", c, tokens[i].Value)
+			return
+		}
+	}
+}
+
 func Test_LexerError(t *testing.T) {
 	l := lexer.New("1", WhitespaceState)
 	l.ErrorHandler = func(e string) {}
@@ -201,4 +271,2695 @@ func Test_LexerError(t *testing.T) {
 		t.Errorf("Expected specific message from error, but got %q", l.Err.Error())
 		return
 	}
+
+	lexErr, ok := l.Err.(*lexer.LexError)
+	if !ok {
+		t.Errorf("Expected a *lexer.LexError, but got %T", l.Err)
+		return
+	}
+
+	if lexErr.Pos != 1 || lexErr.TokenStart != 0 || lexErr.Line != 1 || lexErr.Column != 2 {
+		t.Errorf("Expected the error at 1 in a token starting at 0, but got %+v", *lexErr)
+		return
+	}
+}
+
+func Test_LexerLineColumn(t *testing.T) {
+	cases := []struct {
+		val          string
+		line, column int
+	}{
+		{"ab", 1, 1},
+		{"c\nd", 1, 4},
+		{"é", 2, 3},
+	}
+
+	l := lexer.New("ab c\nd é", func(l *lexer.L) lexer.StateFunc {
+		l.Next()
+		l.Next()
+		l.Emit(IdentToken)
+		l.Next()
+		l.Ignore()
+		l.TakeMany("c\nd")
+		l.Emit(IdentToken)
+		l.Next()
+		l.Ignore()
+		l.Next()
+		l.Emit(IdentToken)
+		return nil
+	})
+	l.RunLexer()
+
+	for _, c := range cases {
+		tok, done := l.NextToken()
+		if done {
+			t.Error("Expected there to be more tokens, but there weren't")
+			return
+		}
+
+		if c.val != tok.Value {
+			t.Errorf("Expected %q but got %q", c.val, tok.Value)
+			return
+		}
+
+		if c.line != tok.Line || c.column != tok.Column {
+			t.Errorf("Expected %d:%d but got %d:%d", c.line, c.column, tok.Line, tok.Column)
+			return
+		}
+	}
+}
+
+func Test_LexerBackupAcrossNewline(t *testing.T) {
+	l := lexer.New("ab\ncd", nil)
+	for i := 0; i < 4; i++ {
+		l.Next()
+	}
+
+	if l.Line != 2 || l.Column != 2 {
+		t.Errorf("Expected 2:2 but got %d:%d", l.Line, l.Column)
+		return
+	}
+
+	l.Backup()
+	l.Backup()
+	if l.Line != 1 || l.Column != 3 {
+		t.Errorf("Expected 1:3 but got %d:%d", l.Line, l.Column)
+		return
+	}
+}
+
+func Test_LexerContextCancel(t *testing.T) {
+	var forever lexer.StateFunc
+	forever = func(l *lexer.L) lexer.StateFunc {
+		l.Emit(NumberToken)
+		return forever
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := lexer.New("1", forever)
+	l.RunLexerContext(ctx)
+
+	if _, done := l.NextToken(); done {
+		t.Error("Expected a token, but lexer was finished")
+		return
+	}
+
+	cancel()
+	for {
+		if _, done := l.NextToken(); done {
+			break
+		}
+	}
+
+	if l.Err != context.Canceled {
+		t.Errorf("Expected %v but got %v", context.Canceled, l.Err)
+		return
+	}
+}
+
+func Test_LexerEmitValue(t *testing.T) {
+	l := lexer.New(`"abc"`, func(l *lexer.L) lexer.StateFunc {
+		l.TakeMany(`"abc`)
+		l.EmitValue(IdentToken, strings.Trim(l.Current(), `"`))
+		return nil
+	})
+	l.RunLexer()
+
+	tok, done := l.NextToken()
+	if done {
+		t.Error("Expected a token, but lexer was finished")
+		return
+	}
+
+	if tok.Value != "abc" {
+		t.Errorf("Expected %q but got %q", "abc", tok.Value)
+		return
+	}
+
+	if tok.Start != 0 || tok.End != 5 {
+		t.Errorf("Expected token to span 0-5 but got %d-%d", tok.Start, tok.End)
+		return
+	}
+}
+
+func Test_LexerPushPopState(t *testing.T) {
+	var inner, outer lexer.StateFunc
+	inner = func(l *lexer.L) lexer.StateFunc {
+		l.TakeMany("0123456789")
+		l.Emit(NumberToken)
+		return l.ReturnState()
+	}
+	outer = func(l *lexer.L) lexer.StateFunc {
+		if l.Take("(") {
+			l.Emit(OpToken)
+			l.PushState(outer)
+			return inner
+		}
+		if l.Take(")") {
+			l.Emit(OpToken)
+		}
+		return l.PopState()
+	}
+
+	cases := []string{"(", "12", ")"}
+	l := lexer.New("(12)", outer)
+	l.RunLexer()
+
+	for _, c := range cases {
+		tok, done := l.NextToken()
+		if done {
+			t.Error("Expected there to be more tokens, but there weren't")
+			return
+		}
+
+		if c != tok.Value {
+			t.Errorf("Expected %q but got %q", c, tok.Value)
+			return
+		}
+	}
+
+	if _, done := l.NextToken(); !done {
+		t.Error("Expected the lexer to be done, but it wasn't.")
+		return
+	}
+}
+
+func Test_LexerAcceptString(t *testing.T) {
+	l := lexer.New("<=x", nil)
+	if l.AcceptString("<=x!") {
+		t.Error("Expected AcceptString to fail past the end of input")
+		return
+	}
+
+	if l.AcceptString("<<") {
+		t.Error("Expected AcceptString to fail on a mismatch")
+		return
+	}
+
+	if l.Current() != "" {
+		t.Errorf("Expected empty string, but got %q", l.Current())
+		return
+	}
+
+	if !l.AcceptString("<=") {
+		t.Error("Expected AcceptString to match")
+		return
+	}
+
+	if l.Current() != "<=" {
+		t.Errorf("Expected %q but got %q", "<=", l.Current())
+		return
+	}
+
+	l.Backup()
+	if l.Current() != "<" {
+		t.Errorf("Expected %q but got %q", "<", l.Current())
+		return
+	}
+}
+
+func Test_LexerTakeManyPatternAtEOF(t *testing.T) {
+	for _, p := range []string{".", `\S`, "a*"} {
+		l := lexer.New("abc", nil)
+		l.TakeManyPattern(regexp.MustCompile(p))
+		if l.Current() != "abc" {
+			t.Errorf("Expected %q but got %q", "abc", l.Current())
+			return
+		}
+
+		if l.TakePattern(regexp.MustCompile(p)) {
+			t.Errorf("Expected %q not to match EOF", p)
+			return
+		}
+	}
+}
+
+func Test_LexerTakeWhileUntil(t *testing.T) {
+	l := lexer.New("héllo1 wörld", nil)
+	if n := l.TakeWhile(unicode.IsLetter); n != 5 {
+		t.Errorf("Expected 5 runes but got %d", n)
+		return
+	}
+
+	if n := l.TakeUntil(unicode.IsSpace); n != 1 {
+		t.Errorf("Expected 1 rune but got %d", n)
+		return
+	}
+
+	l.Ignore()
+	if n := l.TakeUntil(unicode.IsDigit); n != 6 {
+		t.Errorf("Expected 6 runes but got %d", n)
+		return
+	}
+
+	if l.Current() != " wörld" {
+		t.Errorf("Expected %q but got %q", " wörld", l.Current())
+		return
+	}
+}
+
+func Test_LexerAll(t *testing.T) {
+	cases := []string{"123", ".", "hello", "675", ".", "world"}
+
+	l := lexer.New("123.hello  675.world", NumberState)
+	i := 0
+	for tok := range l.All() {
+		if cases[i] != tok.Value {
+			t.Errorf("Expected %q but got %q", cases[i], tok.Value)
+			return
+		}
+		i++
+	}
+
+	if i != len(cases) {
+		t.Errorf("Expected %d tokens but got %d", len(cases), i)
+		return
+	}
+}
+
+func Test_LexerAllBreak(t *testing.T) {
+	var forever lexer.StateFunc
+	forever = func(l *lexer.L) lexer.StateFunc {
+		l.Emit(NumberToken)
+		return forever
+	}
+
+	l := lexer.New("1", forever)
+	for range l.All() {
+		break
+	}
+	l.Drain()
+}
+
+func Test_LexerDrain(t *testing.T) {
+	l := lexer.New("123.hello  675.world", NumberState)
+	l.BufferSize = 1
+	l.RunLexer()
+	l.NextToken()
+	l.Drain()
+
+	if _, done := l.NextToken(); !done {
+		t.Error("Expected the lexer to be done, but it wasn't.")
+		return
+	}
+}
+
+func Test_LexerReset(t *testing.T) {
+	l := lexer.New("123", NumberState)
+	l.RunLexerSync()
+	l.Reset("4567")
+	l.RunLexerSync()
+
+	tok, done := l.NextToken()
+	if done {
+		t.Error("Expected a token, but lexer was finished")
+		return
+	}
+
+	if tok.Value != "4567" || tok.Start != 0 || tok.Line != 1 || tok.Column != 1 {
+		t.Errorf("Expected %q at the start of the input but got %q at %d", "4567", tok.Value, tok.Start)
+		return
+	}
+
+	if _, done := l.NextToken(); !done {
+		t.Error("Expected the lexer to be done, but it wasn't.")
+		return
+	}
+}
+
+func Test_LexerNextTokenErr(t *testing.T) {
+	l := lexer.New("1", WhitespaceState)
+	l.ErrorHandler = func(e string) {}
+	l.RunLexer()
+
+	tok, err := l.NextTokenErr()
+	if tok != nil {
+		t.Errorf("Expected no token, but got %v", *tok)
+		return
+	}
+
+	if err == nil || err.Error() != "unexpected token '1'" {
+		t.Errorf("Expected specific error, but got %v", err)
+		return
+	}
+
+	l = lexer.New("123", NumberState)
+	l.RunLexer()
+	if tok, err = l.NextTokenErr(); tok == nil || err != nil {
+		t.Errorf("Expected a token and no error, but got %v", err)
+		return
+	}
+
+	if tok, err = l.NextTokenErr(); tok != nil || err != nil {
+		t.Errorf("Expected clean completion, but got %v", err)
+		return
+	}
+}
+
+func Test_LexerErrorWithoutHandler(t *testing.T) {
+	l := lexer.New("1", func(l *lexer.L) lexer.StateFunc {
+		l.Next()
+		l.Error("bad")
+		return NumberState
+	})
+	l.RunLexer()
+
+	tok, done := l.NextToken()
+	if done {
+		t.Error("Expected an error token, but lexer was finished")
+		return
+	}
+
+	if tok.Type != lexer.ErrorToken || tok.Value != "bad" || tok.End != 1 {
+		t.Errorf("Expected an error token, but got %v", *tok)
+		return
+	}
+
+	if _, done := l.NextToken(); !done {
+		t.Error("Expected the lexer to be done, but it wasn't.")
+		return
+	}
+}
+
+func Test_LexerCollectTokens(t *testing.T) {
+	cases := []struct {
+		tokType lexer.TokenType
+		val     string
+	}{
+		{NumberToken, "123"},
+		{OpToken, "."},
+		{IdentToken, "hello"},
+		{lexer.EOFToken, ""},
+	}
+
+	tokens, err := lexer.New("123.hello", NumberState).CollectTokens()
+	if err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+		return
+	}
+
+	if len(tokens) != len(cases) {
+		t.Errorf("Expected %d tokens but got %d", len(cases), len(tokens))
+		return
+	}
+
+	for i, c := range cases {
+		if c.tokType != tokens[i].Type || c.val != tokens[i].Value {
+			t.Errorf("Expected %q but got %v", c.val, tokens[i])
+			return
+		}
+	}
+
+	if tokens[3].Start != 9 {
+		t.Errorf("Expected EOF at 9 but got %d", tokens[3].Start)
+		return
+	}
+}
+
+func Test_LexerTakeFold(t *testing.T) {
+	l := lexer.New("AéKİx", nil)
+	for _, chars := range []string{"a", "É", "K", "İ"} {
+		if !l.TakeFold(chars) {
+			t.Errorf("Expected %q to fold-match, but it didn't", chars)
+			return
+		}
+	}
+
+	if l.TakeFold("i") {
+		t.Error("Expected TakeFold to reject a non-matching rune")
+		return
+	}
+
+	if l.Current() != "AéKİ" {
+		t.Errorf("Expected %q but got %q", "AéKİ", l.Current())
+		return
+	}
+}
+
+func Test_LexerBackupMany(t *testing.T) {
+	l := lexer.New("abcd", nil)
+	l.Next()
+	l.Ignore()
+	l.TakeMany("bcd")
+
+	if n := l.BackupMany(2); n != 2 {
+		t.Errorf("Expected to back up 2 runes but got %d", n)
+		return
+	}
+
+	if l.Current() != "b" {
+		t.Errorf("Expected %q but got %q", "b", l.Current())
+		return
+	}
+
+	if n := l.BackupMany(5); n != 1 {
+		t.Errorf("Expected to back up 1 rune but got %d", n)
+		return
+	}
+
+	if l.Position != 1 {
+		t.Errorf("Expected position 1 but got %d", l.Position)
+		return
+	}
+
+	l = lexer.New("abc", nil)
+	for i := 0; i < 4; i++ {
+		l.Next()
+	}
+	if n := l.BackupMany(2); n != 2 || l.Position != 1 {
+		t.Errorf("Expected to back up 2 runes to position 1 but got %d to %d", n, l.Position)
+		return
+	}
+}
+
+func Test_LexerPeekString(t *testing.T) {
+	l := lexer.New("a/*é", nil)
+	l.Next()
+
+	if s := l.PeekString(2); s != "/*" {
+		t.Errorf("Expected %q but got %q", "/*", s)
+		return
+	}
+
+	if s := l.PeekString(5); s != "/*é" {
+		t.Errorf("Expected %q but got %q", "/*é", s)
+		return
+	}
+
+	if l.Current() != "a" {
+		t.Errorf("Expected %q but got %q", "a", l.Current())
+		return
+	}
+
+	l.Backup()
+	if l.Current() != "" {
+		t.Errorf("Expected empty string, but got %q", l.Current())
+		return
+	}
+}
+
+func Test_LexerErrorf(t *testing.T) {
+	l := lexer.New("a\nbc}", func(l *lexer.L) lexer.StateFunc {
+		l.TakeMany("abc\n")
+		l.Errorf("unexpected character %q", l.Peek())
+		return nil
+	})
+	l.ErrorHandler = func(e string) {}
+	l.RunLexerSync()
+
+	if l.Err == nil || l.Err.Error() != "line 2:3: unexpected character '}'" {
+		t.Errorf("Expected specific message from error, but got %v", l.Err)
+		return
+	}
+}
+
+func Test_LexerStatePanic(t *testing.T) {
+	l := lexer.New("1", func(l *lexer.L) lexer.StateFunc {
+		panic("boom")
+	})
+	l.RunLexer()
+
+	tok, done := l.NextToken()
+	if done {
+		t.Error("Expected an error token, but lexer was finished")
+		return
+	}
+
+	if tok.Type != lexer.ErrorToken || tok.Value != "panic: boom" {
+		t.Errorf("Expected an error token, but got %v", *tok)
+		return
+	}
+
+	if _, done := l.NextToken(); !done {
+		t.Error("Expected the lexer to be done, but it wasn't.")
+		return
+	}
+}
+
+func Test_LexerAcceptRun(t *testing.T) {
+	l := lexer.New("123a", nil)
+	if n := l.AcceptRun("abc"); n != 0 {
+		t.Errorf("Expected 0 runes but got %d", n)
+		return
+	}
+
+	if n := l.AcceptRun("0123456789"); n != 3 {
+		t.Errorf("Expected 3 runes but got %d", n)
+		return
+	}
+
+	if l.Current() != "123" {
+		t.Errorf("Expected %q but got %q", "123", l.Current())
+		return
+	}
+}
+
+func Test_LexerIgnoreCharacter(t *testing.T) {
+	l := lexer.New(`a\"b c`, func(l *lexer.L) lexer.StateFunc {
+		for r := l.Next(); r != ' '; r = l.Next() {
+			if r == '\\' {
+				l.IgnoreCharacter()
+				l.Next()
+			}
+		}
+		l.Backup()
+		l.Emit(IdentToken)
+		l.Next()
+		l.Ignore()
+		l.Next()
+		l.Emit(IdentToken)
+		return nil
+	})
+	l.RunLexer()
+
+	cases := []struct {
+		val        string
+		start, end int
+	}{
+		{`a"b`, 0, 4},
+		{"c", 5, 6},
+	}
+	for _, c := range cases {
+		tok, done := l.NextToken()
+		if done {
+			t.Error("Expected there to be more tokens, but there weren't")
+			return
+		}
+
+		if c.val != tok.Value || c.start != tok.Start || c.end != tok.End {
+			t.Errorf("Expected %q at %d-%d but got %q at %d-%d", c.val, c.start, c.end, tok.Value, tok.Start, tok.End)
+			return
+		}
+	}
+}
+
+func Test_LexerCheckpointRestore(t *testing.T) {
+	l := lexer.New("ab\ncd", nil)
+	l.Next()
+	cp := l.Checkpoint()
+
+	l.TakeMany("b\nc")
+	l.PushState(NumberState)
+	l.Restore(cp)
+
+	if l.Current() != "a" || l.Line != 1 || l.Column != 2 {
+		t.Errorf("Expected %q at 1:2 but got %q at %d:%d", "a", l.Current(), l.Line, l.Column)
+		return
+	}
+
+	if l.PopState() != nil {
+		t.Error("Expected the pushed state to be discarded")
+		return
+	}
+
+	l.Backup()
+	if l.Current() != "" {
+		t.Errorf("Expected empty string, but got %q", l.Current())
+		return
+	}
+}
+
+func Test_LexerBufferSize(t *testing.T) {
+	l := lexer.New("123.hello  675.world", NumberState)
+	l.BufferSize = 2
+	l.RunLexer()
+
+	if c := cap(l.Tokens); c != 2 {
+		t.Errorf("Expected a buffer of 2 but got %d", c)
+		return
+	}
+
+	n := 0
+	for {
+		if _, done := l.NextToken(); done {
+			break
+		}
+		n++
+	}
+
+	if n != 6 {
+		t.Errorf("Expected 6 tokens but got %d", n)
+		return
+	}
+}
+
+func Test_LexerTakeCategory(t *testing.T) {
+	l := lexer.New("_héllo9 x", nil)
+	if l.TakeCategory(unicode.Letter) {
+		t.Error("Expected TakeCategory to reject '_'")
+		return
+	}
+
+	if !l.TakeCategory(unicode.Letter, unicode.Pc) {
+		t.Error("Expected TakeCategory to take '_'")
+		return
+	}
+
+	l.TakeManyCategory(unicode.Letter, unicode.Digit)
+	if l.Current() != "_héllo9" {
+		t.Errorf("Expected %q but got %q", "_héllo9", l.Current())
+		return
+	}
+}
+
+func Test_LexerStateHook(t *testing.T) {
+	cases := []struct {
+		name string
+		pos  int
+	}{
+		{"NumberState", 0},
+		{"IdentState", 2},
+		{"WhitespaceState", 3},
+	}
+
+	var i int
+	l := lexer.New("1.a", NumberState)
+	l.StateHook = func(name string, pos int) {
+		if i >= len(cases) {
+			t.Errorf("Unexpected state %s", name)
+			return
+		}
+
+		if !strings.HasSuffix(name, "."+cases[i].name) || pos != cases[i].pos {
+			t.Errorf("Expected %s at %d but got %s at %d", cases[i].name, cases[i].pos, name, pos)
+		}
+		i++
+	}
+	l.BufferSize = 3
+	l.RunLexerSync()
+
+	if i != len(cases) {
+		t.Errorf("Expected %d states but got %d", len(cases), i)
+		return
+	}
+}
+
+func Test_LexerBackupAtEOF(t *testing.T) {
+	l := lexer.New("ab", nil)
+	l.Next()
+	l.Next()
+	if l.Next() != -1 || l.Next() != -1 {
+		t.Error("Expected EOF past the end of input")
+		return
+	}
+
+	l.Backup()
+	l.Backup()
+	if l.Position != 2 {
+		t.Errorf("Expected position 2 but got %d", l.Position)
+		return
+	}
+
+	l.Backup()
+	if l.Current() != "a" {
+		t.Errorf("Expected %q but got %q", "a", l.Current())
+		return
+	}
+}
+
+func Test_LexerEmitError(t *testing.T) {
+	l := lexer.New("x", func(l *lexer.L) lexer.StateFunc {
+		r := l.Next()
+		return l.EmitError("bad rune %q", r)
+	})
+	l.ErrorHandler = func(e string) {
+		t.Errorf("Did not expect the handler to be called with %q", e)
+	}
+	l.RunLexer()
+
+	tok, err := l.NextTokenErr()
+	if tok == nil || tok.Type != lexer.ErrorToken || tok.Value != "bad rune 'x'" {
+		t.Errorf("Expected an error token, but got %v", tok)
+		return
+	}
+
+	if tok, err = l.NextTokenErr(); tok != nil || err == nil {
+		t.Errorf("Expected the lexer to be done with an error, but got %v", err)
+		return
+	}
+}
+
+func Test_LexerRunePosition(t *testing.T) {
+	l := lexer.New("héllo wörld", func(l *lexer.L) lexer.StateFunc {
+		l.TakeWhile(unicode.IsLetter)
+		l.Emit(IdentToken)
+		l.Next()
+		l.Ignore()
+		l.TakeWhile(unicode.IsLetter)
+		l.Next()
+		l.Backup()
+		l.Emit(IdentToken)
+		return nil
+	})
+	l.RunLexer()
+
+	cases := []struct {
+		start, end, runeStart, runeEnd int
+	}{
+		{0, 6, 0, 5},
+		{7, 13, 6, 11},
+	}
+	for _, c := range cases {
+		tok, done := l.NextToken()
+		if done {
+			t.Error("Expected there to be more tokens, but there weren't")
+			return
+		}
+
+		if c.start != tok.Start || c.end != tok.End || c.runeStart != tok.RuneStart || c.runeEnd != tok.RuneEnd {
+			t.Errorf("Expected %v but got %d-%d (runes %d-%d)", c, tok.Start, tok.End, tok.RuneStart, tok.RuneEnd)
+			return
+		}
+	}
+}
+
+func Test_LexerSkipWhitespace(t *testing.T) {
+	l := lexer.New(" \t \r\n x", nil)
+	l.SkipWhitespaceNoNewline()
+	if l.Peek() != '\n' {
+		t.Errorf("Expected to stop at a newline, but got %q", l.Peek())
+		return
+	}
+
+	l.SkipWhitespace()
+	if l.Peek() != 'x' || l.Current() != "" {
+		t.Errorf("Expected to skip to 'x', but got %q", l.Peek())
+		return
+	}
+}
+
+func Test_LexerLastToken(t *testing.T) {
+	l := lexer.New("1-", func(l *lexer.L) lexer.StateFunc {
+		if _, ok := l.LastToken(); ok {
+			t.Error("Did not expect a last token before emitting")
+		}
+
+		l.Next()
+		l.Emit(NumberToken)
+		l.Next()
+		if last, ok := l.LastToken(); !ok || last.Type != NumberToken || last.Value != "1" {
+			t.Errorf("Expected the number token to be last, but got %v", last)
+		}
+
+		l.EmitValue(OpToken, "minus")
+		if last, _ := l.LastToken(); last.Value != "minus" {
+			t.Errorf("Expected %q but got %q", "minus", last.Value)
+		}
+		return nil
+	})
+	l.BufferSize = 2
+	l.RunLexerSync()
+}
+
+func Test_LexerAcceptRune(t *testing.T) {
+	l := lexer.New("é)", nil)
+	if l.AcceptRune(')') {
+		t.Error("Expected AcceptRune to reject 'é'")
+		return
+	}
+
+	if !l.AcceptRune('é') || !l.AcceptRune(')') {
+		t.Error("Expected AcceptRune to take \"é)\"")
+		return
+	}
+
+	if l.AcceptRune(')') || l.Current() != "é)" {
+		t.Errorf("Expected %q but got %q", "é)", l.Current())
+		return
+	}
+}
+
+func Test_TokenNames(t *testing.T) {
+	const PlusToken lexer.TokenType = 100
+	lexer.RegisterTokenName(PlusToken, "Plus")
+
+	if s := (lexer.Token{Type: PlusToken, Value: "+"}).String(); s != `Plus("+")` {
+		t.Errorf("Expected %q but got %q", `Plus("+")`, s)
+		return
+	}
+
+	if s := (lexer.Token{Type: 101, Value: "+"}).String(); s != `"+"` {
+		t.Errorf("Expected %q but got %q", `"+"`, s)
+		return
+	}
+
+	if s := lexer.EOFToken.String(); s != "EOF" {
+		t.Errorf("Expected %q but got %q", "EOF", s)
+		return
+	}
+}
+
+func Test_LexerLookingAt(t *testing.T) {
+	float := regexp.MustCompile(`\A\d+\.\d+([eE][-+]?\d+)?`)
+	inputs := []*lexer.L{
+		lexer.New("x1.5e-3+", nil),
+		lexer.NewFromBytes([]byte("x1.5e-3+"), nil),
+		lexer.NewFromReader(strings.NewReader("x1.5e-3+"), nil),
+	}
+
+	for _, l := range inputs {
+		if _, ok := l.LookingAt(float); ok {
+			t.Error("Did not expect a match before the number")
+			return
+		}
+
+		l.Next()
+		l.Ignore()
+		if m, ok := l.LookingAt(float); !ok || m != "1.5e-3" {
+			t.Errorf("Expected %q but got %q", "1.5e-3", m)
+			return
+		}
+
+		if l.Current() != "1.5e-3" || l.Peek() != '+' {
+			t.Errorf("Expected %q but got %q", "1.5e-3", l.Current())
+			return
+		}
+	}
+
+	if _, ok := lexer.New("a1.5", nil).LookingAt(regexp.MustCompile(`\d+`)); ok {
+		t.Error("Did not expect a match that begins later in the input")
+		return
+	}
+}
+
+func Test_LexerLookingAtNormalizeNewlines(t *testing.T) {
+	l := lexer.New("a\r\nb", nil)
+	l.NormalizeNewlines = true
+	l.Next()
+	if m, ok := l.LookingAt(regexp.MustCompile(`\A\r`)); ok {
+		t.Errorf("Did not expect a match inside a CRLF, but got %q", m)
+		return
+	}
+
+	if m, ok := l.LookingAt(regexp.MustCompile(`\A\r\n`)); !ok || m != "\r\n" {
+		t.Errorf("Expected %q but got %q", "\r\n", m)
+		return
+	}
+	if l.Current() != "a\n" || l.Peek() != 'b' {
+		t.Errorf("Expected %q but got %q", "a\n", l.Current())
+		return
+	}
+}
+
+func Test_LexerTakeManyRewindAtEOF(t *testing.T) {
+	takes := []func(l *lexer.L){
+		func(l *lexer.L) { l.TakeMany("abc") },
+		func(l *lexer.L) { l.TakeManyPattern(regexp.MustCompile(".")) },
+		func(l *lexer.L) { l.TakeWhile(unicode.IsLetter) },
+	}
+
+	for _, take := range takes {
+		l := lexer.New("abc", nil)
+		take(l)
+		if n := l.Rewind.Len(); n != 3 {
+			t.Errorf("Expected 3 runes on the Rewind stack but got %d", n)
+			return
+		}
+
+		l.Backup()
+		if l.Current() != "ab" {
+			t.Errorf("Expected %q but got %q", "ab", l.Current())
+			return
+		}
+	}
+}
+
+func Test_LexerEmitWith(t *testing.T) {
+	l := lexer.New("0x1f", func(l *lexer.L) lexer.StateFunc {
+		l.AcceptString("0x")
+		l.TakeMany("0123456789abcdef")
+		l.EmitWith(NumberToken, 16)
+		return nil
+	})
+	l.RunLexer()
+
+	tok, done := l.NextToken()
+	if done {
+		t.Error("Expected a token, but lexer was finished")
+		return
+	}
+
+	if tok.Value != "0x1f" || tok.Attr != 16 {
+		t.Errorf("Expected %q with base 16 but got %q with %v", "0x1f", tok.Value, tok.Attr)
+		return
+	}
+}
+
+func Test_LexerSublex(t *testing.T) {
+	l := lexer.New("é\n'123.abc'", nil)
+	tokens := l.Sublex(4, 11, NumberState)
+
+	cases := []struct {
+		val                         string
+		start, runeStart, line, col int
+	}{
+		{"123", 4, 3, 2, 2},
+		{".", 7, 6, 2, 5},
+		{"abc", 8, 7, 2, 6},
+	}
+	if len(tokens) != len(cases) {
+		t.Errorf("Expected %d tokens but got %d", len(cases), len(tokens))
+		return
+	}
+
+	for i, c := range cases {
+		tok := tokens[i]
+		if c.val != tok.Value || c.start != tok.Start || c.runeStart != tok.RuneStart || c.line != tok.Line || c.col != tok.Column {
+			t.Errorf("Expected %v but got %q at %d (rune %d, %d:%d)", c, tok.Value, tok.Start, tok.RuneStart, tok.Line, tok.Column)
+			return
+		}
+	}
+}
+
+func Test_LexerSublexReader(t *testing.T) {
+	var before, after []lexer.Token
+	state := func(l *lexer.L) lexer.StateFunc {
+		l.TakeWhile(unicode.IsLetter)
+		l.Emit(IdentToken)
+		l.Next()
+		l.TakeWhile(unicode.IsLetter)
+		after = l.Sublex(3, 5, IdentState)
+		before = l.Sublex(0, 2, IdentState)
+		return nil
+	}
+
+	l := lexer.NewFromReader(strings.NewReader("aa bb cc"), state)
+	if _, err := l.CollectTokens(); err != nil {
+		t.Errorf("Expected no error but got %q", err)
+		return
+	}
+	if before != nil {
+		t.Errorf("Expected no tokens but got %v", before)
+		return
+	}
+	if len(after) != 1 || after[0].Value != "bb" || after[0].Start != 3 {
+		t.Errorf("Expected %q but got %v", "bb", after)
+		return
+	}
+}
+
+func Test_LexerAcceptSequence(t *testing.T) {
+	l := lexer.New("<<=<=", nil)
+	for _, want := range []string{"<<", "=", "<="} {
+		if got, ok := l.AcceptSequence("<", "=", "<=", "<<"); !ok || got != want {
+			t.Errorf("Expected %q but got %q", want, got)
+			return
+		}
+	}
+
+	if got, ok := l.AcceptSequence("<", "="); ok {
+		t.Errorf("Did not expect a match at EOF, but got %q", got)
+		return
+	}
+}
+
+func Test_LexerRestConsumed(t *testing.T) {
+	inputs := []*lexer.L{
+		lexer.New("key: value", nil),
+		lexer.NewFromBytes([]byte("key: value"), nil),
+		lexer.NewFromReader(strings.NewReader("key: value"), nil),
+	}
+
+	for _, l := range inputs {
+		l.AcceptString("key:")
+		if l.Rest() != " value" || l.Consumed() != "key:" {
+			t.Errorf("Expected %q and %q but got %q and %q", "key:", " value", l.Consumed(), l.Rest())
+			return
+		}
+
+		if l.Current() != "key:" || l.Peek() != ' ' {
+			t.Errorf("Expected %q but got %q", "key:", l.Current())
+			return
+		}
+	}
+}
+
+func Test_LexerEmitNonEmpty(t *testing.T) {
+	l := lexer.New("1a", func(l *lexer.L) lexer.StateFunc {
+		if l.EmitNonEmpty(IdentToken) {
+			t.Error("Did not expect an empty token to be emitted")
+		}
+
+		l.TakeMany("0123456789")
+		if !l.EmitNonEmpty(NumberToken) {
+			t.Error("Expected the number to be emitted")
+		}
+
+		l.TakeMany("0123456789")
+		l.EmitNonEmpty(NumberToken)
+		return nil
+	})
+
+	tokens, _ := l.CollectTokens()
+	if len(tokens) != 2 || tokens[0].Value != "1" || tokens[1].Type != lexer.EOFToken {
+		t.Errorf("Expected a single number token, but got %v", tokens)
+		return
+	}
+}
+
+func Test_LexerRuneAt(t *testing.T) {
+	l := lexer.New("aéb", nil)
+	l.Next()
+
+	cases := []struct {
+		offset int
+		r      rune
+	}{
+		{-2, -1},
+		{-1, 'a'},
+		{0, 'é'},
+		{1, 'b'},
+		{2, -1},
+	}
+	for _, c := range cases {
+		if r := l.RuneAt(c.offset); r != c.r {
+			t.Errorf("Expected %q at %d but got %q", c.r, c.offset, r)
+			return
+		}
+	}
+
+	if l.Position != 1 || l.Rewind.Len() != 1 {
+		t.Error("Did not expect RuneAt to change the lexer")
+		return
+	}
+}
+
+func Test_LexerMaxTokens(t *testing.T) {
+	var forever lexer.StateFunc
+	forever = func(l *lexer.L) lexer.StateFunc {
+		l.Emit(NumberToken)
+		return forever
+	}
+
+	l := lexer.New("1", forever)
+	l.MaxTokens = 3
+	tokens, err := l.CollectTokens()
+	if err == nil {
+		t.Error("Expected an error to be on the lexer, but none found.")
+		return
+	}
+
+	if len(tokens) != 5 || tokens[3].Type != lexer.ErrorToken {
+		t.Errorf("Expected 3 tokens followed by an error, but got %v", tokens)
+		return
+	}
+}
+
+func Test_LexerBackupInvalidUTF8(t *testing.T) {
+	l := lexer.New("a\xffb", nil)
+	l.Next()
+	l.Next()
+	l.Next()
+	l.Backup()
+	l.Backup()
+
+	if l.Position != 1 || l.Current() != "a" {
+		t.Errorf("Expected %q at 1 but got %q at %d", "a", l.Current(), l.Position)
+		return
+	}
+
+	l.Backup()
+	l.Backup()
+	if l.Position != 0 || l.Current() != "" {
+		t.Errorf("Expected empty string at 0, but got %q at %d", l.Current(), l.Position)
+		return
+	}
+}
+
+func Test_LexerEmitAnd(t *testing.T) {
+	l := lexer.New("12", func(l *lexer.L) lexer.StateFunc {
+		l.Next()
+		return l.EmitAnd(NumberToken, NumberState)
+	})
+
+	tokens, _ := l.CollectTokens()
+	if len(tokens) != 3 || tokens[0].Value != "1" || tokens[1].Value != "2" {
+		t.Errorf("Expected tokens %q and %q, but got %v", "1", "2", tokens)
+		return
+	}
+}
+
+func Test_LexerIndentation(t *testing.T) {
+	const (
+		IndentToken lexer.TokenType = iota + 10
+		DedentToken
+	)
+
+	var line lexer.StateFunc
+	line = func(l *lexer.L) lexer.StateFunc {
+		if !l.EmitIndent(IndentToken, DedentToken) {
+			return nil
+		}
+		if l.Peek() == -1 {
+			return nil
+		}
+		l.TakeUntil(func(r rune) bool { return r == '\n' })
+		l.Emit(IdentToken)
+		l.AcceptRune('\n')
+		l.Ignore()
+		return line
+	}
+
+	l := lexer.New("a\n  b\n\tc\n    d\ne", line)
+	l.IndentTabWidth = 4
+	tokens, err := l.CollectTokens()
+	if err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+		return
+	}
+
+	cases := []lexer.TokenType{IdentToken, IndentToken, IdentToken, IndentToken, IdentToken, IdentToken, DedentToken, DedentToken, IdentToken, lexer.EOFToken}
+	if len(tokens) != len(cases) {
+		t.Errorf("Expected %d tokens but got %v", len(cases), tokens)
+		return
+	}
+
+	for i, c := range cases {
+		if c != tokens[i].Type {
+			t.Errorf("Expected token type %v but got %v at %d", c, tokens[i].Type, i)
+			return
+		}
+	}
+
+	if l.MeasureIndent() != 0 {
+		t.Errorf("Expected no indentation at EOF, but got %d", l.MeasureIndent())
+		return
+	}
+
+	l = lexer.New("a\n    b\n  c", line)
+	l.ErrorHandler = func(e string) {}
+	if _, err = l.CollectTokens(); err == nil {
+		t.Error("Expected an inconsistent dedent to be an error")
+		return
+	}
+}
+
+func Test_TokenSet(t *testing.T) {
+	set := lexer.NewTokenSet(NumberToken, lexer.EOFToken)
+	if !set.Contains(lexer.EOFToken) || set.Contains(OpToken) {
+		t.Error("Expected the set to hold exactly its token types")
+		return
+	}
+
+	if !(lexer.Token{Type: NumberToken}).In(set) || (lexer.Token{Type: IdentToken}).In(set) {
+		t.Error("Expected In to check the token type against the set")
+		return
+	}
+}
+
+func Test_LexerStep(t *testing.T) {
+	l := lexer.New("1.a", NumberState)
+	l.BufferSize = 3
+
+	if !l.Step() {
+		t.Error("Expected the lexer to continue after the first step")
+		return
+	}
+
+	if l.Position != 2 || len(l.Tokens) != 2 {
+		t.Errorf("Expected 2 tokens by position 2 but got %d by %d", len(l.Tokens), l.Position)
+		return
+	}
+
+	steps := 1
+	for l.Step() {
+		steps++
+	}
+
+	if steps != 2 || len(l.Tokens) != 3 {
+		t.Errorf("Expected 3 tokens after 3 steps but got %d after %d", len(l.Tokens), steps+1)
+		return
+	}
+
+	if l.Step() {
+		t.Error("Expected the lexer to stay ended")
+		return
+	}
+}
+
+func Test_LexerPeekBack(t *testing.T) {
+	l := lexer.New("\\é", nil)
+	if r := l.PeekBack(); r != -1 {
+		t.Errorf("Expected EOF at the start but got %q", r)
+		return
+	}
+
+	l.Next()
+	l.Ignore()
+	if r := l.PeekBack(); r != '\\' {
+		t.Errorf("Expected %q but got %q", '\\', r)
+		return
+	}
+
+	l.Next()
+	l.Next()
+	if r := l.PeekBack(); r != 'é' || l.Current() != "é" {
+		t.Errorf("Expected %q but got %q", 'é', r)
+		return
+	}
+}
+
+func Test_TokenIsErrorIsEOF(t *testing.T) {
+	if !(lexer.Token{Type: lexer.EOFToken}).IsEOF() || (lexer.Token{Type: lexer.EOFToken}).IsError() {
+		t.Error("Expected an EOF token to only be EOF")
+		return
+	}
+
+	if !(lexer.Token{Type: lexer.ErrorToken}).IsError() || (lexer.Token{Type: lexer.FirstUserToken}).IsError() {
+		t.Error("Expected only an error token to be an error")
+		return
+	}
+}
+
+func Test_LexerFilter(t *testing.T) {
+	l := lexer.New("123.hello  675.world", NumberState)
+	var values []string
+	for tok := range l.Filter(func(tok lexer.Token) bool { return tok.Type != OpToken }) {
+		values = append(values, tok.Value)
+	}
+
+	if strings.Join(values, " ") != "123 hello 675 world" {
+		t.Errorf("Expected the op tokens to be dropped, but got %q", values)
+		return
+	}
+}
+
+func Test_LexerAcceptUntilString(t *testing.T) {
+	l := lexer.New("/* a * b */ c", nil)
+	l.AcceptString("/*")
+	if !l.AcceptUntilString("*/") || l.Current() != "/* a * b " {
+		t.Errorf("Expected %q but got %q", "/* a * b ", l.Current())
+		return
+	}
+
+	l.AcceptString("*/")
+	l.Ignore()
+	if l.AcceptUntilString("*/") || l.Current() != " c" {
+		t.Errorf("Expected %q but got %q", " c", l.Current())
+		return
+	}
+
+	l.Backup()
+	if l.Current() != " " {
+		t.Errorf("Expected %q but got %q", " ", l.Current())
+		return
+	}
+}
+
+func Test_LexerProgress(t *testing.T) {
+	l := lexer.New("abcd", nil)
+	l.Next()
+	if l.Progress() != 0.25 || l.BytesRemaining() != 3 {
+		t.Errorf("Expected 0.25 with 3 bytes left but got %v with %d", l.Progress(), l.BytesRemaining())
+		return
+	}
+
+	l = lexer.NewFromReader(strings.NewReader("abcd"), nil)
+	l.Next()
+	if l.Progress() != -1 || l.BytesRemaining() != -1 {
+		t.Errorf("Expected unknown progress but got %v with %d", l.Progress(), l.BytesRemaining())
+		return
+	}
+}
+
+func Test_LexerEmitRest(t *testing.T) {
+	l := lexer.New("HEAD\nbody\ntext", func(l *lexer.L) lexer.StateFunc {
+		l.TakeUntil(unicode.IsSpace)
+		l.Emit(IdentToken)
+		l.SkipWhitespace()
+		l.EmitRest(OpToken)
+		return nil
+	})
+
+	tokens, _ := l.CollectTokens()
+	if len(tokens) != 3 || tokens[1].Value != "body\ntext" || tokens[1].End != 14 || tokens[2].Line != 3 {
+		t.Errorf("Expected the body as one token, but got %v", tokens)
+		return
+	}
+}
+
+func Test_LexerNilStartState(t *testing.T) {
+	l := lexer.New("1", nil)
+	l.RunLexer()
+
+	tok, done := l.NextToken()
+	if done || tok.Type != lexer.ErrorToken {
+		t.Error("Expected an error token for a missing start state")
+		return
+	}
+
+	if _, done := l.NextToken(); !done || l.Err == nil {
+		t.Error("Expected the lexer to be done with an error")
+		return
+	}
+}
+
+func Test_LexerTakeMinMax(t *testing.T) {
+	const hex = "0123456789abcdefABCDEF"
+	l := lexer.New("12g4567", nil)
+	if l.TakeMinMax(hex, 4, 4) || l.Current() != "" {
+		t.Errorf("Expected an underflow to take nothing, but got %q", l.Current())
+		return
+	}
+
+	if !l.TakeMinMax(hex, 1, 4) || l.Current() != "12" {
+		t.Errorf("Expected %q but got %q", "12", l.Current())
+		return
+	}
+
+	l.Next()
+	l.Ignore()
+	if !l.TakeMinMax(hex, 2, 3) || l.Current() != "456" {
+		t.Errorf("Expected %q but got %q", "456", l.Current())
+		return
+	}
+}
+
+func Test_LexerEmitTrimmed(t *testing.T) {
+	l := lexer.New("  value \t;   ;", func(l *lexer.L) lexer.StateFunc {
+		for l.Peek() != -1 {
+			l.TakeUntil(func(r rune) bool { return r == ';' })
+			l.EmitTrimmed(IdentToken)
+			l.Next()
+			l.Ignore()
+		}
+		return nil
+	})
+
+	tokens, _ := l.CollectTokens()
+	if len(tokens) != 3 || tokens[0].Value != "value" || tokens[0].End != 9 || tokens[1].Value != "" {
+		t.Errorf("Expected trimmed values, but got %v", tokens)
+		return
+	}
+}
+
+func Test_LexerNextPull(t *testing.T) {
+	cases := []string{"123", ".", "hello", "675", ".", "world"}
+
+	l := lexer.New("123.hello  675.world", NumberState)
+	for _, c := range cases {
+		tok, ok := l.NextPull()
+		if !ok {
+			t.Error("Expected there to be more tokens, but there weren't")
+			return
+		}
+
+		if c != tok.Value {
+			t.Errorf("Expected %q but got %q", c, tok.Value)
+			return
+		}
+	}
+
+	if _, ok := l.NextPull(); ok {
+		t.Error("Expected the lexer to be done, but it wasn't.")
+		return
+	}
+
+	if l.Tokens != nil {
+		t.Error("Did not expect a Tokens channel to be made")
+		return
+	}
+}
+
+func Test_LexerAcceptAnyOf(t *testing.T) {
+	ops := []rune{'∀', '∃', '∧', '∨'}
+	l := lexer.New("∀∧∨x", nil)
+	if !l.AcceptAnyOf(ops) {
+		t.Error("Expected AcceptAnyOf to take '∀'")
+		return
+	}
+
+	if n := l.AcceptRunOf(ops); n != 2 || l.Current() != "∀∧∨" {
+		t.Errorf("Expected %q but got %q", "∀∧∨", l.Current())
+		return
+	}
+
+	if l.AcceptAnyOf(ops) {
+		t.Error("Expected AcceptAnyOf to reject 'x'")
+		return
+	}
+}
+
+func Test_LexerRunLexerFunc(t *testing.T) {
+	stop := errors.New("stop")
+	var values []string
+	l := lexer.New("123.hello  675.world", NumberState)
+	l.RunLexerFunc(func(tok lexer.Token) error {
+		values = append(values, tok.Value)
+		if tok.Type == IdentToken {
+			return stop
+		}
+		return nil
+	})
+
+	if strings.Join(values, " ") != "123 . hello" {
+		t.Errorf("Expected the lexer to stop after the first identifier, but got %q", values)
+		return
+	}
+
+	if l.Err != stop {
+		t.Errorf("Expected %v but got %v", stop, l.Err)
+		return
+	}
+}
+
+func Test_LexerPeekMany(t *testing.T) {
+	l := lexer.New("aéb", nil)
+	l.Next()
+
+	cases := []struct {
+		n int
+		r rune
+	}{
+		{1, 'é'},
+		{2, 'b'},
+		{3, -1},
+	}
+	for _, c := range cases {
+		if r := l.PeekMany(c.n); r != c.r {
+			t.Errorf("Expected %q but got %q", c.r, r)
+			return
+		}
+	}
+
+	if l.Peek() != 'é' || l.Rewind.Len() != 1 || l.Current() != "a" {
+		t.Error("Did not expect peeking to change the lexer")
+		return
+	}
+
+	if n := testing.AllocsPerRun(10, func() { l.PeekMany(2) }); n != 0 {
+		t.Errorf("Expected PeekMany not to allocate, but it allocated %v times", n)
+		return
+	}
+}
+
+func Test_LexerNextBatch(t *testing.T) {
+	var wordState lexer.StateFunc
+	wordState = func(l *lexer.L) lexer.StateFunc {
+		l.SkipWhitespace()
+		if l.TakeWhile(func(r rune) bool { return r != ' ' && r != -1 }) == 0 {
+			return nil
+		}
+		l.Emit(NumberToken)
+		return wordState
+	}
+	l := lexer.New("1 2 3 4 5", wordState)
+	l.BufferSize = 8
+	l.RunLexerSync()
+
+	batch := l.NextBatch(3)
+	if len(batch) != 3 || batch[2].Value != "3" {
+		t.Errorf("Expected 3 tokens ending in %q but got %v", "3", batch)
+		return
+	}
+
+	batch = l.NextBatch(3)
+	if len(batch) != 2 || batch[1].Value != "5" {
+		t.Errorf("Expected 2 tokens ending in %q but got %v", "5", batch)
+		return
+	}
+
+	if batch = l.NextBatch(3); len(batch) != 0 {
+		t.Errorf("Expected an empty batch but got %v", batch)
+		return
+	}
+}
+
+func Test_LexerIgnoreRange(t *testing.T) {
+	l := lexer.New("ab\\\ncd\\\nef gh", func(l *lexer.L) lexer.StateFunc {
+		l.TakeWhile(func(r rune) bool { return r != ' ' })
+		l.IgnoreRange(6, 8)
+		l.IgnoreRange(2, 4)
+		l.IgnoreRange(3, 5)
+		if l.Current() != "abdef" {
+			l.Error(fmt.Sprintf("Expected %q but got %q", "abdef", l.Current()))
+			return nil
+		}
+
+		l.IgnoreRange(0, 3)
+		l.IgnoreRange(9, 20)
+		l.Emit(IdentToken)
+		return nil
+	})
+	l.BufferSize = 1
+	l.RunLexerSync()
+
+	tok, _ := l.NextToken()
+	if tok.Value != "de" || tok.Start != 0 || tok.End != 10 {
+		t.Errorf("Expected %q spanning 0-10 but got %q spanning %d-%d", "de", tok.Value, tok.Start, tok.End)
+		return
+	}
+}
+
+func Test_LexerNextValidated(t *testing.T) {
+	l := lexer.New("a�\xff", nil)
+
+	cases := []struct {
+		r     rune
+		valid bool
+	}{
+		{'a', true},
+		{'�', true},
+		{'�', false},
+		{-1, true},
+	}
+	for _, c := range cases {
+		if r, valid := l.NextValidated(); r != c.r || valid != c.valid {
+			t.Errorf("Expected %q (%v) but got %q (%v)", c.r, c.valid, r, valid)
+			return
+		}
+	}
+}
+
+func Test_LexerNewNamed(t *testing.T) {
+	var reg lexer.StateRegistry
+	reg.Register("number", NumberState)
+
+	if _, err := lexer.NewNamed("123", "ident", &reg); err == nil {
+		t.Error("Expected an error for an unregistered state")
+		return
+	}
+
+	l, err := lexer.NewNamed("123", "number", &reg)
+	if err != nil {
+		t.Errorf("Expected no error but got %q", err)
+		return
+	}
+	l.RunLexer()
+
+	tok, _ := l.NextToken()
+	if tok.Value != "123" {
+		t.Errorf("Expected %q but got %q", "123", tok.Value)
+		return
+	}
+}
+
+func Test_LexerAtomicPosition(t *testing.T) {
+	l := lexer.New("123 abc", NumberState)
+	l.RunLexer()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 100 {
+			l.AtomicStart()
+			l.AtomicPosition()
+		}
+	}()
+
+	l.Drain()
+	<-done
+	if l.AtomicPosition() != 3 || l.AtomicStart() != 3 {
+		t.Errorf("Expected %d but got %d", 3, l.AtomicPosition())
+		return
+	}
+}
+
+func Test_LexerTakeDelimited(t *testing.T) {
+	cases := []struct {
+		input, content, rest string
+		ok                   bool
+	}{
+		{`"a\"b" c`, `a"b`, " c", true},
+		{`"a\\" c"`, `a\`, ` c"`, true},
+		{`"a\nb"`, `a\nb`, "", true},
+		{`""`, "", "", true},
+		{`"" rest"`, "", ` rest"`, true},
+		{`"abc`, "abc", "", false},
+		{`"abc\`, `abc\`, "", false},
+	}
+	for _, c := range cases {
+		l := lexer.New(c.input, nil)
+		l.Next()
+		l.Ignore()
+		content, ok := l.TakeDelimited('"', '"', '\\')
+		if content != c.content || ok != c.ok || l.Rest() != c.rest {
+			t.Errorf("Expected %q (%v) leaving %q but got %q (%v) leaving %q", c.content, c.ok, c.rest, content, ok, l.Rest())
+			return
+		}
+	}
+}
+
+func Test_LexerRecoverTo(t *testing.T) {
+	isSemicolon := func(r rune) bool { return r == ';' }
+	var state lexer.StateFunc
+	state = func(l *lexer.L) lexer.StateFunc {
+		switch r := l.Peek(); {
+		case r == -1:
+			return nil
+		case r == ';':
+			l.Next()
+			l.Ignore()
+		case unicode.IsDigit(r):
+			l.TakeWhile(unicode.IsDigit)
+			l.Emit(NumberToken)
+		default:
+			l.Error(fmt.Sprintf("unexpected %q", r))
+			l.RecoverTo(isSemicolon)
+		}
+		return state
+	}
+
+	l := lexer.New("1;x!;2;y", state)
+	var values []string
+	l.RunLexerFunc(func(tok lexer.Token) error {
+		values = append(values, tok.Value)
+		return nil
+	})
+
+	expected := []string{"1", `unexpected 'x'`, "2", `unexpected 'y'`}
+	if fmt.Sprint(values) != fmt.Sprint(expected) {
+		t.Errorf("Expected %q but got %q", expected, values)
+		return
+	}
+
+	if errs := l.Errors(); len(errs) != 2 || errs[1] != l.Err {
+		t.Errorf("Expected 2 errors ending in Err but got %v", errs)
+		return
+	}
+}
+
+func Test_LexerSpan(t *testing.T) {
+	l := lexer.New("abc def", nil)
+	l.TakeWhile(unicode.IsLetter)
+	l.Ignore()
+	l.SkipWhitespace()
+	l.Next()
+	l.Next()
+
+	if start, end := l.Span(); start != 4 || end != 6 {
+		t.Errorf("Expected %d-%d but got %d-%d", 4, 6, start, end)
+		return
+	}
+}
+
+func Test_LexerTakeDigits(t *testing.T) {
+	l := lexer.New("123٤٥x", nil)
+	if value, n := l.TakeDigits(); value != 123 || n != 3 {
+		t.Errorf("Expected %d (%d digits) but got %d (%d digits)", 123, 3, value, n)
+		return
+	}
+
+	l = lexer.New("123٤٥x", nil)
+	l.DigitClassifier = lexer.UnicodeDigit
+	if value, n := l.TakeDigits(); value != 12345 || n != 5 || l.Current() != "123٤٥" {
+		t.Errorf("Expected %d (%d digits) but got %d (%d digits)", 12345, 5, value, n)
+		return
+	}
+
+	for _, r := range "0٠०０𝟎" {
+		if d, ok := lexer.UnicodeDigit(r + 7); d != 7 || !ok {
+			t.Errorf("Expected %q to be 7 but got %d", r+7, d)
+			return
+		}
+	}
+}
+
+func Test_LexerEmitToken(t *testing.T) {
+	l := lexer.New("abc def", func(l *lexer.L) lexer.StateFunc {
+		l.TakeWhile(unicode.IsLetter)
+		l.Next()
+		l.EmitToken(lexer.Token{Type: IdentToken, Value: "ABC", Start: 0, End: 3})
+		if l.Rewind.Len() != 0 || l.Current() != " " {
+			l.Error(fmt.Sprintf("Expected %q but got %q", " ", l.Current()))
+			return nil
+		}
+
+		l.EmitToken(lexer.Token{Type: IdentToken, Value: "DEF", Start: 4, End: 7})
+		return nil
+	})
+	l.BufferSize = 2
+	l.RunLexerSync()
+
+	for _, expected := range []string{"ABC", "DEF"} {
+		tok, done := l.NextToken()
+		if done || tok.Value != expected {
+			t.Errorf("Expected %q but got %v", expected, tok)
+			return
+		}
+	}
+	if start, end := l.Span(); start != 7 || end != 7 {
+		t.Errorf("Expected %d-%d but got %d-%d", 7, 7, start, end)
+		return
+	}
+}
+
+func Test_LexerValidate(t *testing.T) {
+	const (
+		digitsToken = lexer.FirstUserToken + iota
+		commaToken
+	)
+	state := func(l *lexer.L) lexer.StateFunc {
+		for l.TakeWhile(unicode.IsDigit) > 0 {
+			l.Emit(digitsToken)
+			if !l.AcceptRune(',') {
+				break
+			}
+			l.Emit(commaToken)
+		}
+		switch l.Peek() {
+		case -1:
+		case '!':
+			l.Next()
+			l.EmitValue(lexer.ErrorToken, "bad")
+			l.Errorf("after %q", "bad")
+		default:
+			l.Errorf("unexpected %q", l.Peek())
+		}
+		return nil
+	}
+
+	if err := lexer.New("123", state).Validate(); err != nil {
+		t.Errorf("Expected no error but got %q", err)
+		return
+	}
+
+	if err := lexer.New("12x", state).Validate(); err == nil || err.Error() != `line 1:3: unexpected 'x'` {
+		t.Errorf("Expected %q but got %v", `line 1:3: unexpected 'x'`, err)
+		return
+	}
+
+	if err := lexer.New("1,2!", state).Validate(); err == nil || err.Error() != "bad" {
+		t.Errorf("Expected %q but got %v", "bad", err)
+		return
+	}
+}
+
+func Test_LexerSeek(t *testing.T) {
+	l := lexer.New("12 é\n34 56", func(l *lexer.L) lexer.StateFunc {
+		l.TakeWhile(unicode.IsDigit)
+		l.Emit(NumberToken)
+		return nil
+	})
+	l.Next()
+
+	for _, pos := range []int{-1, 4, 13} {
+		if err := l.Seek(pos); err == nil {
+			t.Errorf("Expected an error seeking to %d", pos)
+			return
+		}
+	}
+
+	if err := l.Seek(6); err != nil {
+		t.Errorf("Expected no error but got %q", err)
+		return
+	}
+	if l.Rewind.Len() != 0 {
+		t.Errorf("Expected an empty Rewind stack but got %d runes", l.Rewind.Len())
+		return
+	}
+
+	l.RunLexerSync()
+	tok, _ := l.NextToken()
+	if tok.Value != "34" || tok.Line != 2 || tok.Column != 1 || tok.RuneStart != 5 {
+		t.Errorf("Expected %q at 2:1 but got %q at %d:%d", "34", tok.Value, tok.Line, tok.Column)
+		return
+	}
+}
+
+func Test_LexerEmitEOF(t *testing.T) {
+	l := lexer.New("123", NumberState)
+	l.EmitEOF = true
+	l.RunLexer()
+
+	l.NextToken()
+	tok, done := l.NextToken()
+	if done || !tok.IsEOF() || tok.Start != 3 || tok.End != 3 {
+		t.Errorf("Expected an EOF token at 3 but got %v", tok)
+		return
+	}
+	if _, done := l.NextToken(); !done {
+		t.Error("Expected the lexer to be finished after the EOF token")
+		return
+	}
+
+	tokens, _ := lexer.New("123", NumberState).CollectTokens()
+	l = lexer.New("123", NumberState)
+	l.EmitEOF = true
+	withEOF, _ := l.CollectTokens()
+	if len(tokens) != 2 || len(withEOF) != 2 {
+		t.Errorf("Expected 2 tokens but got %d and %d", len(tokens), len(withEOF))
+		return
+	}
+}
+
+func Test_LexerCountMatching(t *testing.T) {
+	l := lexer.New("a---b", nil)
+	l.Next()
+
+	if n := l.CountMatching("-"); n != 3 {
+		t.Errorf("Expected %d but got %d", 3, n)
+		return
+	}
+	if n := l.CountMatching("ab"); n != 0 {
+		t.Errorf("Expected %d but got %d", 0, n)
+		return
+	}
+	if l.Position != 1 || l.Rewind.Len() != 1 {
+		t.Error("Did not expect CountMatching to change the lexer")
+		return
+	}
+}
+
+func Test_LexerLazyValues(t *testing.T) {
+	input := "123.abc"
+	l := lexer.New(input, NumberState)
+	l.LazyValues = true
+	tokens, _ := l.CollectTokens()
+
+	expected := []string{"123", ".", "abc", ""}
+	if len(tokens) != len(expected) {
+		t.Errorf("Expected %d tokens but got %d", len(expected), len(tokens))
+		return
+	}
+	for i, tok := range tokens {
+		if tok.Value != "" {
+			t.Errorf("Expected an empty value but got %q", tok.Value)
+			return
+		}
+		if v := tok.Resolve(input); v != expected[i] {
+			t.Errorf("Expected %q but got %q", expected[i], v)
+			return
+		}
+	}
+}
+
+func Test_LexerNoValues(t *testing.T) {
+	input := "123.abc"
+	l := lexer.New(input, NumberState)
+	l.NoValues = true
+	tokens, _ := l.CollectTokens()
+
+	if len(tokens) != 4 || tokens[2].Type != IdentToken || tokens[2].Start != 4 || tokens[2].End != 7 {
+		t.Errorf("Expected an IdentToken at 4-7 but got %v", tokens)
+		return
+	}
+	for _, tok := range tokens {
+		if tok.Value != "" {
+			t.Errorf("Expected an empty value but got %q", tok.Value)
+			return
+		}
+	}
+	if v := tokens[2].Resolve(input); v != "abc" {
+		t.Errorf("Expected %q but got %q", "abc", v)
+		return
+	}
+}
+
+func Test_LexerUnshift(t *testing.T) {
+	l := lexer.New("123.abc", NumberState)
+	l.Unshift(lexer.Token{Type: IdentToken, Value: "x", Start: 10, End: 11})
+	l.Unshift(lexer.Token{Type: IdentToken, Value: "y"})
+	l.RunLexer()
+
+	var values []string
+	for {
+		tok, done := l.NextToken()
+		if done {
+			break
+		}
+		values = append(values, tok.Value)
+		if tok.Value == "." {
+			l.Unshift(lexer.Token{Type: IdentToken, Value: "z"})
+		}
+	}
+
+	expected := []string{"x", "y", "123", ".", "z", "abc"}
+	if fmt.Sprint(values) != fmt.Sprint(expected) {
+		t.Errorf("Expected %q but got %q", expected, values)
+		return
+	}
+}
+
+func Test_LexerMatchKeyword(t *testing.T) {
+	keywords := lexer.NewKeywords("int", "interface", "in", "-", "->")
+
+	cases := []struct {
+		input, keyword string
+		ok             bool
+	}{
+		{"int x", "int", true},
+		{"interface{}", "interface", true},
+		{"in(", "in", true},
+		{"inter", "", false},
+		{"integer", "", false},
+		{"->x", "->", true},
+		{"-x", "-", true},
+		{"x", "", false},
+	}
+	for _, c := range cases {
+		l := lexer.New(c.input, nil)
+		keyword, ok := l.MatchKeyword(keywords)
+		if keyword != c.keyword || ok != c.ok || l.Current() != c.keyword {
+			t.Errorf("Expected %q (%v) but got %q (%v)", c.keyword, c.ok, keyword, ok)
+			return
+		}
+	}
+}
+
+func Test_LexerRunLexerChannel(t *testing.T) {
+	l := lexer.New("123.abc", NumberState)
+
+	var values []string
+	for tok := range l.RunLexer() {
+		values = append(values, tok.Value)
+	}
+
+	expected := []string{"123", ".", "abc"}
+	if fmt.Sprint(values) != fmt.Sprint(expected) {
+		t.Errorf("Expected %q but got %q", expected, values)
+		return
+	}
+}
+
+func Test_LexerTakeBalanced(t *testing.T) {
+	cases := []struct {
+		input, content, rest string
+		ok                   bool
+	}{
+		{"(a(b)c) d", "a(b)c", " d", true},
+		{"()", "", "", true},
+		{"(a(b)", "a(b)", "", false},
+		{"((a)) tail", "(a)", " tail", true},
+	}
+	for _, c := range cases {
+		l := lexer.New(c.input, nil)
+		l.Next()
+		l.Ignore()
+		content, ok := l.TakeBalanced('(', ')')
+		if content != c.content || ok != c.ok || l.Rest() != c.rest {
+			t.Errorf("Expected %q (%v) leaving %q but got %q (%v) leaving %q", c.content, c.ok, c.rest, content, ok, l.Rest())
+			return
+		}
+	}
+
+	l := lexer.New("|a|b", nil)
+	l.Next()
+	l.Ignore()
+	if content, ok := l.TakeBalanced('|', '|'); content != "a" || !ok || l.Rest() != "b" {
+		t.Errorf("Expected %q leaving %q but got %q (%v) leaving %q", "a", "b", content, ok, l.Rest())
+		return
+	}
+}
+
+func Test_LexerTakeBalancedNormalizeNewlines(t *testing.T) {
+	l := lexer.New("#a\r\nb", nil)
+	l.NormalizeNewlines = true
+	l.Next()
+	l.Ignore()
+	content, ok := l.TakeBalanced('#', '\n')
+	if content != "a" || !ok || l.Rest() != "b" {
+		t.Errorf("Expected %q leaving %q but got %q leaving %q", "a", "b", content, l.Rest())
+		return
+	}
+}
+
+func Test_LexerOnEmit(t *testing.T) {
+	l := lexer.New("123.abc", NumberState)
+	l.OnEmit = func(tok *lexer.Token) {
+		tok.Value = strings.ToUpper(tok.Value)
+	}
+	tokens, _ := l.CollectTokens()
+
+	if tokens[2].Value != "ABC" {
+		t.Errorf("Expected %q but got %q", "ABC", tokens[2].Value)
+		return
+	}
+	if last, _ := l.LastToken(); last.Value != "ABC" {
+		t.Errorf("Expected %q but got %q", "ABC", last.Value)
+		return
+	}
+
+	l = lexer.New("1", func(l *lexer.L) lexer.StateFunc {
+		l.EmitToken(lexer.Token{Type: lexer.ErrorToken, Value: "bad"})
+		l.Next()
+		l.Emit(lexer.EOFToken)
+		return nil
+	})
+	l.OnEmit = func(tok *lexer.Token) {
+		t.Errorf("Did not expect %q to be passed to OnEmit", tok.Value)
+	}
+	l.CollectTokens()
+}
+
+func Test_LexerOnEmitLazyValues(t *testing.T) {
+	l := lexer.New("123.abc", NumberState)
+	l.LazyValues = true
+	var seen []string
+	l.OnEmit = func(tok *lexer.Token) {
+		seen = append(seen, tok.Value)
+		tok.Value = strings.ToUpper(tok.Value)
+	}
+	tokens, _ := l.CollectTokens()
+
+	if len(seen) != 3 || seen[2] != "abc" {
+		t.Errorf("Expected %q but got %q", "abc", seen)
+		return
+	}
+	if v := tokens[2].Resolve(l.Input); v != "ABC" {
+		t.Errorf("Expected %q but got %q", "ABC", v)
+		return
+	}
+}
+
+func Test_LexerTokenCount(t *testing.T) {
+	l := lexer.New("123.abc", NumberState)
+	l.CollectTokens()
+	if l.TokenCount() != 3 {
+		t.Errorf("Expected %d but got %d", 3, l.TokenCount())
+		return
+	}
+
+	l.Reset("456")
+	if l.TokenCount() != 0 {
+		t.Errorf("Expected %d but got %d", 0, l.TokenCount())
+		return
+	}
+	l.CollectTokens()
+	if l.TokenCount() != 1 {
+		t.Errorf("Expected %d but got %d", 1, l.TokenCount())
+		return
+	}
+
+	l = lexer.New("1", func(l *lexer.L) lexer.StateFunc {
+		l.EmitToken(lexer.Token{Type: lexer.ErrorToken, Value: "bad"})
+		l.Next()
+		l.Emit(NumberToken)
+		l.Emit(lexer.EOFToken)
+		return nil
+	})
+	l.CollectTokens()
+	if l.TokenCount() != 1 {
+		t.Errorf("Expected %d but got %d", 1, l.TokenCount())
+		return
+	}
+}
+
+func Test_LexerSkipNestedComment(t *testing.T) {
+	cases := []struct {
+		input, rest string
+		ok          bool
+	}{
+		{"/* a /* b */ c */ d", " d", true},
+		{"/**/x", "x", true},
+		{"/* a /* b */", "", false},
+		{"/*/* x */*/y", "y", true},
+	}
+	for _, c := range cases {
+		l := lexer.New(c.input, nil)
+		l.AcceptString("/*")
+		l.Ignore()
+		ok := l.SkipNestedComment("/*", "*/")
+		if ok != c.ok || l.Rest() != c.rest {
+			t.Errorf("Expected %v leaving %q but got %v leaving %q", c.ok, c.rest, ok, l.Rest())
+			return
+		}
+		if ok && l.Current() != "" {
+			t.Errorf("Expected the comment to be ignored but got %q", l.Current())
+			return
+		}
+	}
+}
+
+func Test_LexerRewindToken(t *testing.T) {
+	l := lexer.New("ab\ncd", nil)
+	l.Next()
+	l.Ignore()
+	l.TakeWhile(func(rune) bool { return true })
+	l.IgnoreCharacter()
+	l.RewindToken()
+
+	if l.Position != 1 || l.Rewind.Len() != 0 || l.Line != 1 || l.Column != 2 || l.RunePosition() != 1 {
+		t.Errorf("Expected the lexer back at 1:2 but got %d:%d", l.Line, l.Column)
+		return
+	}
+	l.TakeWhile(func(rune) bool { return true })
+	if l.Current() != "b\ncd" {
+		t.Errorf("Expected %q but got %q", "b\ncd", l.Current())
+		return
+	}
+}
+
+func Test_TokenCategories(t *testing.T) {
+	const (
+		IntToken lexer.TokenType = iota + 200
+		FloatToken
+		PlusToken
+	)
+	const LiteralCategory lexer.Category = 1
+	lexer.RegisterCategory(LiteralCategory, IntToken, FloatToken)
+
+	if c := (lexer.Token{Type: FloatToken}).Category(); c != LiteralCategory {
+		t.Errorf("Expected %d but got %d", LiteralCategory, c)
+		return
+	}
+	if c := PlusToken.Category(); c != 0 {
+		t.Errorf("Expected %d but got %d", 0, c)
+		return
+	}
+}
+
+func Test_LexerTryNextToken(t *testing.T) {
+	release := make(chan struct{})
+	l := lexer.New("123", func(l *lexer.L) lexer.StateFunc {
+		<-release
+		return NumberState
+	})
+	l.RunLexer()
+
+	if tok, ok, done := l.TryNextToken(); tok != nil || ok || done {
+		t.Errorf("Expected no token to be ready but got %v", tok)
+		return
+	}
+	close(release)
+
+	for {
+		tok, ok, done := l.TryNextToken()
+		if done {
+			t.Error("Expected a token before the lexer finished")
+			return
+		}
+		if ok {
+			if tok.Value != "123" {
+				t.Errorf("Expected %q but got %q", "123", tok.Value)
+				return
+			}
+			break
+		}
+	}
+	for {
+		if _, ok, done := l.TryNextToken(); done {
+			break
+		} else if ok {
+			t.Error("Did not expect another token")
+			return
+		}
+	}
+}
+
+func Test_LexerTabWidth(t *testing.T) {
+	l := lexer.New("\tab\t\tc\n\td", nil)
+	l.TabWidth = 4
+
+	columns := []int{5, 6, 7, 9, 13, 14, 1, 5, 6}
+	for _, column := range columns {
+		l.Next()
+		if l.Column != column {
+			t.Errorf("Expected column %d but got %d", column, l.Column)
+			return
+		}
+	}
+	for i := len(columns) - 2; i >= 0; i-- {
+		l.Backup()
+		if l.Column != columns[i] {
+			t.Errorf("Expected column %d but got %d", columns[i], l.Column)
+			return
+		}
+	}
+
+	l.Backup()
+	if l.Column != 1 {
+		t.Errorf("Expected column %d but got %d", 1, l.Column)
+		return
+	}
+}
+
+func Test_LexerExpectRune(t *testing.T) {
+	cases := []struct {
+		input, err string
+	}{
+		{"}", ""},
+		{";", `line 1:1: expected '}' but got ';'`},
+		{"", `line 1:1: expected '}' but got EOF`},
+	}
+	for _, c := range cases {
+		l := lexer.New(c.input, nil)
+		var err string
+		l.ErrorHandler = func(e string) {
+			err = e
+		}
+		if ok := l.ExpectRune('}'); ok != (c.err == "") || err != c.err {
+			t.Errorf("Expected %q but got %q", c.err, err)
+			return
+		}
+	}
+}
+
+func Test_LexerPeekRunes(t *testing.T) {
+	l := lexer.New("aé->", nil)
+	l.Next()
+
+	if runes := l.PeekRunes(2); string(runes) != "é-" {
+		t.Errorf("Expected %q but got %q", "é-", string(runes))
+		return
+	}
+	if runes := l.PeekRunes(5); string(runes) != "é->" {
+		t.Errorf("Expected %q but got %q", "é->", string(runes))
+		return
+	}
+	if l.Position != 1 || l.Rewind.Len() != 1 {
+		t.Error("Did not expect PeekRunes to change the lexer")
+		return
+	}
+}
+
+func Test_LexerEmitSplit(t *testing.T) {
+	var err error
+	l := lexer.New("aé.b c", func(l *lexer.L) lexer.StateFunc {
+		l.TakeWhile(func(r rune) bool { return r != ' ' })
+		if err = l.EmitSplit([]lexer.Split{{Type: IdentToken, Len: 2}, {Type: OpToken, Len: 1}}); err == nil {
+			return nil
+		}
+		err = l.EmitSplit([]lexer.Split{{Type: IdentToken, Len: 2}, {Type: OpToken, Len: 1}, {Type: IdentToken, Len: 1}})
+		return nil
+	})
+	tokens, _ := l.CollectTokens()
+
+	if err != nil {
+		t.Errorf("Expected no error but got %q", err)
+		return
+	}
+	expected := []lexer.Token{
+		{Type: IdentToken, Value: "aé", Start: 0, End: 3, Line: 1, Column: 1, RuneStart: 0, RuneEnd: 2},
+		{Type: OpToken, Value: ".", Start: 3, End: 4, Line: 1, Column: 3, RuneStart: 2, RuneEnd: 3},
+		{Type: IdentToken, Value: "b", Start: 4, End: 5, Line: 1, Column: 4, RuneStart: 3, RuneEnd: 4},
+	}
+	for i, tok := range expected {
+		if tokens[i] != tok {
+			t.Errorf("Expected %+v but got %+v", tok, tokens[i])
+			return
+		}
+	}
+}
+
+func Test_LexerMarshalTokens(t *testing.T) {
+	const StringToken lexer.TokenType = 300
+	lexer.RegisterTokenName(StringToken, "String")
+
+	tokens := []lexer.Token{
+		{Type: StringToken, Value: "a", Start: 0, End: 3, Line: 1, Column: 1, RuneStart: 0, RuneEnd: 3},
+		{Type: 301, Value: "b", Start: 3, End: 4, Line: 1, Column: 4, RuneStart: 3, RuneEnd: 4},
+		{Type: lexer.EOFToken, Start: 4, End: 4, Line: 1, Column: 5, RuneStart: 4, RuneEnd: 4},
+	}
+	data, err := lexer.MarshalTokens(tokens)
+	if err != nil {
+		t.Errorf("Expected no error but got %q", err)
+		return
+	}
+
+	expected := `[{"type":"String","value":"a","start":0,"end":3,"line":1,"column":1,"runeStart":0,"runeEnd":3},` +
+		`{"type":301,"value":"b","start":3,"end":4,"line":1,"column":4,"runeStart":3,"runeEnd":4},` +
+		`{"type":"EOF","value":"","start":4,"end":4,"line":1,"column":5,"runeStart":4,"runeEnd":4}]`
+	if string(data) != expected {
+		t.Errorf("Expected %s but got %s", expected, data)
+		return
+	}
+
+	decoded, err := lexer.UnmarshalTokens(data)
+	if err != nil {
+		t.Errorf("Expected no error but got %q", err)
+		return
+	}
+	for i, tok := range tokens {
+		if decoded[i] != tok {
+			t.Errorf("Expected %+v but got %+v", tok, decoded[i])
+			return
+		}
+	}
+
+	if _, err := lexer.UnmarshalTokens([]byte(`[{"type":"Unknown"}]`)); err == nil {
+		t.Error("Expected an error for an unregistered token name")
+		return
+	}
+}
+
+func Test_LexerTakeOrError(t *testing.T) {
+	l := lexer.New("12x3", func(l *lexer.L) lexer.StateFunc {
+		for l.TakeOrError("0123456789", IdentToken) || l.Peek() != -1 {
+		}
+		l.EmitNonEmpty(IdentToken)
+		return nil
+	})
+	tokens, err := l.CollectTokens()
+
+	expected := []string{"3 12", "0 unexpected 'x'", "3 3", "-1 "}
+	var got []string
+	for _, tok := range tokens {
+		got = append(got, fmt.Sprintf("%d %s", tok.Type, tok.Value))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("Expected %q but got %q", expected, got)
+		return
+	}
+	if tokens[1].Start != 2 || tokens[1].End != 3 || err == nil {
+		t.Errorf("Expected the error to span 2-3 but got %d-%d", tokens[1].Start, tokens[1].End)
+		return
+	}
+}
+
+func Test_LexerStripBOM(t *testing.T) {
+	l := lexer.New("\uFEFFabc", func(l *lexer.L) lexer.StateFunc {
+		l.StripBOM()
+		l.TakeWhile(unicode.IsLetter)
+		l.Emit(IdentToken)
+		return nil
+	})
+	tokens, _ := l.CollectTokens()
+
+	if tok := tokens[0]; tok.Value != "abc" || tok.Start != 3 || tok.Column != 1 || tok.RuneStart != 1 {
+		t.Errorf("Expected %q at column 1 but got %q at column %d", "abc", tok.Value, tok.Column)
+		return
+	}
+
+	l = lexer.New("abc", nil)
+	if l.StripBOM() || l.Position != 0 {
+		t.Error("Did not expect a byte order mark to be stripped")
+		return
+	}
+}
+
+func Test_LexerNormalizeNewlines(t *testing.T) {
+	l := lexer.New("a\r\nb\rc\r\n", nil)
+	l.NormalizeNewlines = true
+
+	runes := []rune{'a', '\n', 'b', '\r', 'c', '\n', -1}
+	for _, r := range runes {
+		if next := l.Next(); next != r {
+			t.Errorf("Expected %q but got %q", r, next)
+			return
+		}
+	}
+	if l.Current() != "a\nb\rc\n" || l.Line != 3 || l.RunePosition() != 6 {
+		t.Errorf("Expected %q but got %q", "a\nb\rc\n", l.Current())
+		return
+	}
+
+	l.BackupMany(4)
+	if l.Current() != "a\n" || l.Position != 3 || l.Line != 2 {
+		t.Errorf("Expected %q but got %q", "a\n", l.Current())
+		return
+	}
+	l.Backup()
+	if l.Current() != "a" || l.Position != 1 || l.Line != 1 || l.Column != 2 {
+		t.Errorf("Expected %q but got %q", "a", l.Current())
+		return
+	}
+
+	l.Seek(5)
+	if l.Line != 2 || l.Column != 3 || l.RunePosition() != 4 {
+		t.Errorf("Expected 2:3 after %d runes but got %d:%d after %d", 4, l.Line, l.Column, l.RunePosition())
+		return
+	}
+}
+
+func Test_LexerLineNumber(t *testing.T) {
+	l := lexer.New("a\nb\n\nc", nil)
+	l.TakeUntil(func(r rune) bool { return r == 'c' })
+	if l.LineNumber() != 4 {
+		t.Errorf("Expected %d but got %d", 4, l.LineNumber())
+		return
+	}
+	l.BackupMany(2)
+	if l.LineNumber() != 2 {
+		t.Errorf("Expected %d but got %d", 2, l.LineNumber())
+		return
+	}
+}
+
+func Test_Relex(t *testing.T) {
+	l := lexer.New("x = 12.ab", func(l *lexer.L) lexer.StateFunc {
+		l.TakeUntil(unicode.IsDigit)
+		l.Ignore()
+		l.EmitRest(IdentToken)
+		return nil
+	})
+	tokens, _ := l.CollectTokens()
+
+	sub := lexer.Relex(tokens[0], NumberState)
+	expected := []lexer.Token{
+		{Type: NumberToken, Value: "12", Start: 4, End: 6, Line: 1, Column: 5, RuneStart: 4, RuneEnd: 6},
+		{Type: OpToken, Value: ".", Start: 6, End: 7, Line: 1, Column: 7, RuneStart: 6, RuneEnd: 7},
+		{Type: IdentToken, Value: "ab", Start: 7, End: 9, Line: 1, Column: 8, RuneStart: 7, RuneEnd: 9},
+	}
+	if len(sub) != len(expected) {
+		t.Errorf("Expected %d tokens but got %d", len(expected), len(sub))
+		return
+	}
+	for i, tok := range expected {
+		if sub[i] != tok {
+			t.Errorf("Expected %+v but got %+v", tok, sub[i])
+			return
+		}
+	}
+}
+
+func Test_LexerLazyValuesNonEmpty(t *testing.T) {
+	input := "12  34"
+	var state lexer.StateFunc
+	state = func(l *lexer.L) lexer.StateFunc {
+		l.TakeWhile(unicode.IsDigit)
+		l.EmitNonEmpty(NumberToken)
+		if l.TakeWhile(unicode.IsSpace) == 0 {
+			return nil
+		}
+		l.Ignore()
+		return state
+	}
+	l := lexer.NewFromBytes([]byte(input), state)
+	l.LazyValues = true
+	tokens, _ := l.CollectTokens()
+
+	if len(tokens) != 3 || tokens[1].Value != "" || tokens[1].Resolve(input) != "34" {
+		t.Errorf("Expected 3 tokens with lazy values but got %v", tokens)
+		return
+	}
+}
+
+func Test_LexerAcceptRange(t *testing.T) {
+	l := lexer.New("abcZ9", nil)
+
+	if !l.AcceptRange('a', 'z') || l.AcceptRange('0', '9') {
+		t.Errorf("Expected only %q to be taken but got %q", "a", l.Current())
+		return
+	}
+	if n := l.AcceptRunRange('a', 'z'); n != 2 || l.Current() != "abc" {
+		t.Errorf("Expected %q but got %q", "abc", l.Current())
+		return
+	}
+	l.TakeWhile(func(rune) bool { return true })
+	if l.AcceptRange(-1, 'z') || l.AcceptRunRange(-1, 'z') != 0 {
+		t.Error("Did not expect EOF to be taken")
+		return
+	}
+}
+
+func Test_LexerStop(t *testing.T) {
+	var state lexer.StateFunc
+	state = func(l *lexer.L) lexer.StateFunc {
+		l.TakeWhile(unicode.IsDigit)
+		l.Emit(NumberToken)
+		if l.AcceptRune('!') {
+			l.Stop()
+		}
+		l.TakeWhile(unicode.IsSpace)
+		l.Ignore()
+		return state
+	}
+	tokens, err := lexer.New("1 2! 3", state).CollectTokens()
+
+	if len(tokens) != 3 || tokens[1].Value != "2" || err != nil {
+		t.Errorf("Expected the lexer to stop after %q but got %v (%v)", "2", tokens, err)
+		return
+	}
+}
+
+func Test_LexerMaxBacktrack(t *testing.T) {
+	var state lexer.StateFunc
+	state = func(l *lexer.L) lexer.StateFunc {
+		if l.AcceptString("abc") || l.AcceptString("abd") {
+			l.Emit(IdentToken)
+			return state
+		}
+		for l.Next() != -1 {
+		}
+		l.RewindToken()
+		return nil
+	}
+
+	l := lexer.New("abdabdx", state)
+	l.MaxBacktrack = 1
+	if _, err := l.CollectTokens(); err != nil {
+		t.Errorf("Expected no error but got %q", err)
+		return
+	}
+
+	l = lexer.New("abdabdxyz", state)
+	l.MaxBacktrack = 2
+	tokens, err := l.CollectTokens()
+	if err == nil || err.Error() != "backtracking limit of 2 exceeded" || len(tokens) != 4 {
+		t.Errorf("Expected %q but got %v", "backtracking limit of 2 exceeded", err)
+		return
+	}
+}
+
+func Test_LexerMaxBacktrackLookahead(t *testing.T) {
+	var state lexer.StateFunc
+	state = func(l *lexer.L) lexer.StateFunc {
+		l.TakeWhile(unicode.IsLetter)
+		l.TakeWhile(unicode.IsDigit)
+		if l.Current() == "" {
+			l.Next()
+			l.Ignore()
+			if l.Peek() == -1 {
+				return nil
+			}
+			return state
+		}
+		l.Emit(IdentToken)
+		return state
+	}
+
+	l := lexer.New("abc123 de45", state)
+	l.MaxBacktrack = 1
+	tokens, err := l.CollectTokens()
+	if err != nil || len(tokens) != 3 {
+		t.Errorf("Expected no error but got %v", err)
+		return
+	}
+}
+
+func Test_LexerMaxBacktrackRestore(t *testing.T) {
+	var state lexer.StateFunc
+	state = func(l *lexer.L) lexer.StateFunc {
+		for i := 0; i < 50; i++ {
+			cp := l.Checkpoint()
+			for j := 0; j < 100 && l.Next() != -1; j++ {
+			}
+			l.Restore(cp)
+		}
+		return nil
+	}
+
+	l := lexer.New(strings.Repeat("a", 100), state)
+	l.MaxBacktrack = 10
+	_, err := l.CollectTokens()
+	if err == nil || err.Error() != "backtracking limit of 10 exceeded" {
+		t.Errorf("Expected %q but got %v", "backtracking limit of 10 exceeded", err)
+		return
+	}
+}
+
+func Test_LexerIgnoreCharacterTwice(t *testing.T) {
+	l := lexer.New(`a\\b`, nil)
+	l.Next()
+	l.Next()
+	l.Next()
+	l.IgnoreCharacter()
+	l.IgnoreCharacter()
+	if l.Current() != "a" {
+		t.Errorf("Expected %q but got %q", "a", l.Current())
+		return
+	}
+
+	l.Next()
+	l.Backup()
+	l.IgnoreCharacter()
+	if l.Current() != "" {
+		t.Errorf("Expected %q but got %q", "", l.Current())
+		return
+	}
+
+	l = lexer.New("a\r\nb", nil)
+	l.NormalizeNewlines = true
+	l.Next()
+	l.Next()
+	l.IgnoreCharacter()
+	l.Next()
+	if l.Current() != "ab" {
+		t.Errorf("Expected %q but got %q", "ab", l.Current())
+		return
+	}
+}
+
+func Test_LexerSeekAfterStop(t *testing.T) {
+	var state lexer.StateFunc
+	state = func(l *lexer.L) lexer.StateFunc {
+		switch {
+		case l.AcceptRune('!'):
+			l.Error("bang")
+		case l.AcceptRune('.'):
+			return l.Stop()
+		case l.AcceptRune(','):
+			l.Ignore()
+		case l.TakeWhile(unicode.IsDigit) > 0:
+			l.Emit(NumberToken)
+		default:
+			return nil
+		}
+		return state
+	}
+
+	for _, input := range []string{"!12", ".12", "9,9,12"} {
+		l := lexer.New(input, state)
+		l.MaxTokens = 1
+		l.CollectTokens()
+
+		if err := l.Seek(len(input) - 2); err != nil {
+			t.Errorf("Expected no error but got %q", err)
+			return
+		}
+		l.BufferSize = 2
+		l.RunLexerSync()
+		tok, done := l.NextToken()
+		if done || tok.Value != "12" || l.Err != nil || l.TokenCount() != 1 {
+			t.Errorf("Expected %q from a second run over %q but got %v", "12", input, tok)
+			return
+		}
+	}
+}
+
+func Test_LexerUnshiftFromState(t *testing.T) {
+	state := func(l *lexer.L) lexer.StateFunc {
+		l.TakeWhile(unicode.IsLetter)
+		l.Emit(IdentToken)
+		l.Unshift(lexer.Token{Type: IdentToken, Value: "x"})
+		l.SkipWhitespace()
+		l.TakeWhile(unicode.IsLetter)
+		l.Emit(IdentToken)
+		l.Unshift(lexer.Token{Type: IdentToken, Value: "y"})
+		return nil
+	}
+	expected := fmt.Sprint([]string{"a", "x", "b", "y"})
+
+	l := lexer.New("a b", state)
+	var values []string
+	for tok, ok := l.NextPull(); ok; tok, ok = l.NextPull() {
+		values = append(values, tok.Value)
+	}
+	if fmt.Sprint(values) != expected {
+		t.Errorf("Expected %s but got %q", expected, values)
+		return
+	}
+
+	values = nil
+	for tok := range lexer.New("a b", state).All() {
+		values = append(values, tok.Value)
+	}
+	if fmt.Sprint(values) != expected {
+		t.Errorf("Expected %s but got %q", expected, values)
+		return
+	}
+
+	l = lexer.New("a b", state)
+	l.Unshift(lexer.Token{Type: IdentToken, Value: "w"})
+	tokens, _ := l.CollectTokens()
+	values = nil
+	for _, tok := range tokens {
+		values = append(values, tok.Value)
+	}
+	if fmt.Sprint(values) != fmt.Sprint([]string{"w", "a", "x", "b", "y", ""}) {
+		t.Errorf("Expected the queued token first but got %q", values)
+		return
+	}
 }
@@ -0,0 +1,37 @@
+package lexer
+
+import "fmt"
+
+// StateRegistry maps names to state functions, so a lexer's start state can be
+// chosen by name, such as from a grammar loaded at runtime. The zero value is an
+// empty registry ready to use.
+type StateRegistry struct {
+	states map[string]StateFunc
+}
+
+// Register adds f to the registry under name, replacing any state function
+// already registered with that name.
+func (r *StateRegistry) Register(name string, f StateFunc) {
+	if r.states == nil {
+		r.states = make(map[string]StateFunc)
+	}
+	r.states[name] = f
+}
+
+// Lookup returns the state function registered under name, and false if there
+// is none.
+func (r *StateRegistry) Lookup(name string) (StateFunc, bool) {
+	f, ok := r.states[name]
+	return f, ok
+}
+
+// NewNamed creates and returns a lexer ready to parse src, starting with the
+// state function registered in reg under startName. It returns an error if no
+// state function is registered under that name.
+func NewNamed(src string, startName string, reg *StateRegistry) (*L, error) {
+	f, ok := reg.Lookup(startName)
+	if !ok {
+		return nil, fmt.Errorf("no state registered as %q", startName)
+	}
+	return New(src, f), nil
+}
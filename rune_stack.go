@@ -1,12 +1,7 @@
 package lexer
 
-type runeNode struct {
-	r    rune
-	next *runeNode
-}
-
 type runeStack struct {
-	start *runeNode
+	runes []rune
 }
 
 func NewRuneStack() runeStack {
@@ -14,25 +9,30 @@ func NewRuneStack() runeStack {
 }
 
 func (s *runeStack) Push(r rune) {
-	node := &runeNode{r: r}
-	if s.start == nil {
-		s.start = node
-	} else {
-		node.next = s.start
-		s.start = node
-	}
+	s.runes = append(s.runes, r)
 }
 
 func (s *runeStack) Pop() rune {
-	if s.start == nil {
+	if len(s.runes) == 0 {
 		return rune(EOFToken)
 	} else {
-		n := s.start
-		s.start = n.next
-		return n.r
+		r := s.runes[len(s.runes)-1]
+		s.runes = s.runes[:len(s.runes)-1]
+		return r
+	}
+}
+
+func (s *runeStack) Top() rune {
+	if len(s.runes) == 0 {
+		return rune(EOFToken)
 	}
+	return s.runes[len(s.runes)-1]
+}
+
+func (s *runeStack) Len() int {
+	return len(s.runes)
 }
 
 func (s *runeStack) Clear() {
-	s.start = nil
+	s.runes = s.runes[:0]
 }
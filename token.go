@@ -0,0 +1,98 @@
+package lexer
+
+import "strconv"
+
+// tokenNames holds the names given to token types with RegisterTokenName.
+var tokenNames = map[TokenType]string{
+	EOFToken:   "EOF",
+	ErrorToken: "Error",
+}
+
+// RegisterTokenName gives a token type a name, which is used when printing the
+// type and the tokens that carry it. It should be called during initialization,
+// before any lexing starts.
+func RegisterTokenName(t TokenType, name string) {
+	tokenNames[t] = name
+}
+
+// String returns the registered name of the token type, or its number if it
+// has none.
+func (t TokenType) String() string {
+	if name, ok := tokenNames[t]; ok {
+		return name
+	}
+	return strconv.Itoa(int(t))
+}
+
+// Category is a coarse grouping of token types, such as every kind of literal,
+// for parsers that branch on the kind of a token rather than its exact type.
+// The zero Category is the category of token types that were not given one.
+type Category int
+
+// tokenCategories holds the categories given to token types with
+// RegisterCategory.
+var tokenCategories = map[TokenType]Category{}
+
+// RegisterCategory puts the given token types in category c. Like
+// RegisterTokenName, it should be called during initialization, before any
+// lexing starts.
+func RegisterCategory(c Category, types ...TokenType) {
+	for _, t := range types {
+		tokenCategories[t] = c
+	}
+}
+
+// Category returns the category the token type was registered in, or the zero
+// Category if it has none.
+func (t TokenType) Category() Category {
+	return tokenCategories[t]
+}
+
+// TokenSet is a set of token types, for checking a token against several types
+// at once.
+type TokenSet map[TokenType]struct{}
+
+// NewTokenSet returns a set holding the given token types.
+func NewTokenSet(types ...TokenType) TokenSet {
+	s := make(TokenSet, len(types))
+	for _, t := range types {
+		s[t] = struct{}{}
+	}
+	return s
+}
+
+// Contains returns whether t is in the set.
+func (s TokenSet) Contains(t TokenType) bool {
+	_, ok := s[t]
+	return ok
+}
+
+// In returns whether the token's type is in set.
+func (t Token) In(set TokenSet) bool {
+	return set.Contains(t.Type)
+}
+
+// Category returns the category of the token's type.
+func (t Token) Category() Category {
+	return t.Type.Category()
+}
+
+// Resolve returns the value of the token. The value of a token emitted while
+// LazyValues was set is sliced out of input, which must be the input of the
+// lexer that emitted it.
+func (t Token) Resolve(input string) string {
+	if t.lazy {
+		return input[t.Start:t.End]
+	}
+	return t.Value
+}
+
+// IsEOF returns whether the token is an EOFToken.
+func (t Token) IsEOF() bool {
+	return t.Type == EOFToken
+}
+
+// IsError returns whether the token is an ErrorToken.
+func (t Token) IsError() bool {
+	return t.Type == ErrorToken
+}